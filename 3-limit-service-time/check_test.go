@@ -0,0 +1,1002 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleRequestCompleted(t *testing.T) {
+	u := User{ID: 0}
+	process := func() { time.Sleep(100 * time.Millisecond) }
+
+	if !HandleRequest(process, &u) {
+		t.Error("Short process of free user was killed")
+	}
+}
+
+func TestHandleRequestKilled(t *testing.T) {
+	u := User{ID: 0}
+	process := func() { time.Sleep(20 * time.Second) }
+
+	start := time.Now()
+	if HandleRequest(process, &u) {
+		t.Error("Expected 20s process of free user to be killed")
+	}
+	elapsed := time.Since(start)
+	if elapsed < maxFreeProcessingTimeSeconds*time.Second {
+		t.Error("Process killed too early after", elapsed)
+	}
+	if elapsed > maxFreeProcessingTimeSeconds*time.Second+500*time.Millisecond {
+		t.Error("Process killed too late after", elapsed)
+	}
+}
+
+func TestHandleRequestContextCancelled(t *testing.T) {
+	u := User{ID: 0}
+	cancelled := make(chan struct{})
+	process := func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+		case <-time.After(20 * time.Second):
+		}
+	}
+
+	if HandleRequestContext(process, &u) {
+		t.Error("Expected 20s process of free user to be killed")
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Context of killed process not cancelled")
+	}
+}
+
+func TestHandleRequestContextDeadlineBeforeCheck(t *testing.T) {
+	// The quota left is not a multiple of the check interval, so the
+	// deadline fires before the check which would kill the process
+	u := User{ID: 0, TimeUsed: 8050}
+	var ctxErr error
+	process := func(ctx context.Context) {
+		<-ctx.Done()
+		ctxErr = ctx.Err()
+	}
+
+	if HandleRequestContext(process, &u) {
+		t.Error("Expected process returning at its deadline to be killed")
+	}
+	if ctxErr != context.DeadlineExceeded {
+		t.Error("Expected the process to see its deadline, got", ctxErr)
+	}
+	if remaining := RemainingBudget(&u); remaining != 0 {
+		t.Error("Expected no budget left, got", remaining)
+	}
+}
+
+func TestHandleRequestAccumulated(t *testing.T) {
+	u := User{ID: 0}
+
+	if !HandleRequest(func() { time.Sleep(7500 * time.Millisecond) }, &u) {
+		t.Fatal("First 7s process of free user was killed")
+	}
+
+	start := time.Now()
+	if HandleRequest(func() { time.Sleep(5 * time.Second) }, &u) {
+		t.Error("Expected second process to be killed after 10s in total")
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Error("Second process killed too late after", elapsed)
+	}
+
+	if HandleRequest(func() {}, &u) {
+		t.Error("Expected process of user without quota to be rejected")
+	}
+}
+
+func TestHandleRequestConcurrentSameUser(t *testing.T) {
+	u := User{ID: 0}
+
+	// Two concurrent 3s requests fit into the quota
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !HandleRequest(func() { time.Sleep(3100 * time.Millisecond) }, &u) {
+				t.Error("Concurrent 3s process was killed")
+			}
+		}()
+	}
+	wg.Wait()
+	if used := timeUsed(&u); used < 6200*time.Millisecond || used > 6400*time.Millisecond {
+		t.Error("Expected 6.2s used by two 3.1s processes, got", used)
+	}
+
+	// Three concurrent 6s requests exceed the remaining 3.8s together
+	var killed int32
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !HandleRequest(func() { time.Sleep(6 * time.Second) }, &u) {
+				atomic.AddInt32(&killed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if killed != 3 {
+		t.Error("Expected all concurrent processes to be killed, killed", killed)
+	}
+	limit := maxFreeProcessingTimeSeconds * time.Second
+	if used := timeUsed(&u); used < limit || used > limit+3*quotaCheckInterval {
+		t.Error("Unexpected time used after exceeding the quota", used)
+	}
+}
+
+func TestHandleRequestWithLimit(t *testing.T) {
+	for _, limit := range []time.Duration{2 * time.Second, 500 * time.Millisecond} {
+		u := User{ID: 0}
+
+		start := time.Now()
+		if HandleRequestWithLimit(func() { time.Sleep(5 * time.Second) }, &u, limit) {
+			t.Error("Expected process to be killed with limit", limit)
+		}
+		elapsed := time.Since(start)
+		if elapsed < limit || elapsed > limit+300*time.Millisecond {
+			t.Errorf("Expected kill after %v, got %v", limit, elapsed)
+		}
+
+		u = User{ID: 0}
+		if !HandleRequestWithLimit(func() { time.Sleep(limit / 4) }, &u, limit) {
+			t.Error("Short process killed with limit", limit)
+		}
+	}
+}
+
+func TestHandleRequestWithStats(t *testing.T) {
+	u := User{ID: 0}
+
+	stats := HandleRequestWithStats(func() { time.Sleep(1500 * time.Millisecond) }, &u)
+	if stats.Killed {
+		t.Error("1.5s process of free user was killed")
+	}
+	if stats.Elapsed < 1500*time.Millisecond || stats.Elapsed > 1600*time.Millisecond {
+		t.Error("Expected elapsed of about 1.5s, got", stats.Elapsed)
+	}
+	remaining := maxFreeProcessingTimeSeconds*time.Second - stats.Elapsed
+	if diff := stats.RemainingBudget - remaining; diff < -100*time.Millisecond || diff > 100*time.Millisecond {
+		t.Error("Expected remaining budget of about", remaining, "got", stats.RemainingBudget)
+	}
+
+	premium := User{ID: 1, IsPremium: true}
+	stats = HandleRequestWithStats(func() { time.Sleep(100 * time.Millisecond) }, &premium)
+	if stats.Killed || stats.RemainingBudget != unlimitedBudget {
+		t.Error("Unexpected stats for premium user", stats)
+	}
+}
+
+func TestHandleRequestPremiumTimeUsed(t *testing.T) {
+	u := User{ID: 1, IsPremium: true}
+
+	if !HandleRequest(func() { time.Sleep(3100 * time.Millisecond) }, &u) {
+		t.Error("Process of premium user was killed")
+	}
+	if used := timeUsed(&u); used < 3100*time.Millisecond || used > 3200*time.Millisecond {
+		t.Error("Expected 3.1s used by premium user, got", used)
+	}
+}
+
+func TestHandleRequestNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	u := User{ID: 0}
+	for i := 0; i < 1000; i++ {
+		if !HandleRequest(func() {}, &u) {
+			t.Fatal("Fast process was killed")
+		}
+	}
+
+	// Give exiting goroutines a moment to finish
+	var after int
+	for i := 0; i < 10; i++ {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Goroutines leaked: %d before, %d after", before, after)
+}
+
+func TestHandleRequestPausable(t *testing.T) {
+	u := User{ID: 0}
+
+	r := HandleRequestPausable(func() { time.Sleep(3 * time.Second) }, &u, 1500*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	r.Pause()
+	time.Sleep(2 * time.Second)
+	r.Resume()
+
+	if !r.Wait() {
+		t.Error("Process killed although paused for most of its runtime")
+	}
+
+	r = HandleRequestPausable(func() { time.Sleep(3 * time.Second) }, &u, 1500*time.Millisecond)
+	if r.Wait() {
+		t.Error("Expected process running without pause to be killed")
+	}
+}
+
+func TestResetUserQuota(t *testing.T) {
+	u := User{ID: 0}
+
+	if HandleRequestWithLimit(func() { time.Sleep(3 * time.Second) }, &u, time.Second) {
+		t.Fatal("Expected process to be killed after 1s")
+	}
+	if HandleRequestWithLimit(func() {}, &u, time.Second) {
+		t.Fatal("Expected process of exhausted user to be rejected")
+	}
+
+	ResetUserQuota(&u)
+	if used := atomic.LoadInt64(&u.TimeUsed); used != 0 {
+		t.Error("Expected no time used after reset, got", used)
+	}
+	if !HandleRequestWithLimit(func() {}, &u, time.Second) {
+		t.Error("Process rejected after quota reset")
+	}
+}
+
+func TestHandleRequestWithHooks(t *testing.T) {
+	var killed []*User
+	hooks := Hooks{OnKilled: func(u *User) { killed = append(killed, u) }}
+
+	free := User{ID: 0, TimeUsed: (maxFreeProcessingTimeSeconds - 1) * 1000}
+	if !HandleRequestWithHooks(func() {}, &free, hooks) {
+		t.Error("Fast process of free user was killed")
+	}
+
+	premium := User{ID: 1, IsPremium: true, TimeUsed: maxFreeProcessingTimeSeconds * 1000}
+	if !HandleRequestWithHooks(func() { time.Sleep(1100 * time.Millisecond) }, &premium, hooks) {
+		t.Error("Process of premium user was killed")
+	}
+	if len(killed) != 0 {
+		t.Fatal("OnKilled called for completed processes")
+	}
+
+	if HandleRequestWithHooks(func() { time.Sleep(2 * time.Second) }, &free, hooks) {
+		t.Error("Expected process exceeding the quota to be killed")
+	}
+	if len(killed) != 1 || killed[0] != &free {
+		t.Error("Expected OnKilled to be called once with the killed user, got", killed)
+	}
+}
+
+func TestHandleRequestSubSecondBudget(t *testing.T) {
+	u := User{ID: 0}
+
+	start := time.Now()
+	if HandleRequestWithLimit(func() { time.Sleep(time.Second) }, &u, 250*time.Millisecond) {
+		t.Error("Expected 1s process to be killed with a 250ms budget")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond+2*quotaCheckInterval {
+		t.Error("Process killed too late after", elapsed)
+	}
+	if used := timeUsed(&u); used < 250*time.Millisecond || used > 250*time.Millisecond+2*quotaCheckInterval {
+		t.Error("Expected about 250ms used, got", used)
+	}
+}
+
+func TestHandleRequestApproachingLimit(t *testing.T) {
+	u := User{ID: 0}
+
+	start := time.Now()
+	var warnings int32
+	var warnedAfter time.Duration
+	hooks := Hooks{OnApproachingLimit: func(*User) {
+		if atomic.AddInt32(&warnings, 1) == 1 {
+			warnedAfter = time.Since(start)
+		}
+	}}
+
+	if HandleRequestWithHooks(func() { time.Sleep(20 * time.Second) }, &u, hooks) {
+		t.Error("Expected 20s process of free user to be killed")
+	}
+	killedAfter := time.Since(start)
+
+	if warnings != 1 {
+		t.Fatal("Expected a single warning, got", warnings)
+	}
+	if warnedAfter < 8*time.Second || warnedAfter > 8*time.Second+300*time.Millisecond {
+		t.Error("Expected warning after about 8s, got", warnedAfter)
+	}
+	if killedAfter < 10*time.Second || killedAfter > 10*time.Second+300*time.Millisecond {
+		t.Error("Expected kill after about 10s, got", killedAfter)
+	}
+}
+
+func TestHandleRequestUpgradeToPremium(t *testing.T) {
+	u := User{ID: 0}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		UpgradeToPremium(&u)
+	}()
+
+	if !HandleRequestWithLimit(func() { time.Sleep(2 * time.Second) }, &u, time.Second) {
+		t.Error("Process of user upgraded to premium was killed")
+	}
+	if used := timeUsed(&u); used < 2*time.Second {
+		t.Error("Expected upgraded user to be charged the full 2s, got", used)
+	}
+}
+
+func TestHandleRequestGroup(t *testing.T) {
+	u := User{ID: 0}
+	process := func(d time.Duration) func() {
+		return func() { time.Sleep(d) }
+	}
+
+	// 9s in total fit into the shared quota
+	completed := HandleRequestGroup([]func(){process(3 * time.Second), process(3 * time.Second), process(3 * time.Second)}, &u)
+	for i, ok := range completed {
+		if !ok {
+			t.Error("Process", i, "killed although the group fits into the quota")
+		}
+	}
+
+	// 15s in total exceed the quota, which is used up after about
+	// 3.3s, and the whole group gets killed
+	ResetUserQuota(&u)
+	start := time.Now()
+	completed = HandleRequestGroup([]func(){process(5 * time.Second), process(5 * time.Second), process(5 * time.Second)}, &u)
+	for i, ok := range completed {
+		if ok {
+			t.Error("Process", i, "completed although the group exceeded the quota")
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Error("Group killed too late after", elapsed)
+	}
+	limit := maxFreeProcessingTimeSeconds * time.Second
+	if used := timeUsed(&u); used < limit || used > limit+3*quotaCheckInterval {
+		t.Error("Unexpected time used by the group", used)
+	}
+}
+
+// capturingLogger records every message it receives
+type capturingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *capturingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestHandleRequestWithLogger(t *testing.T) {
+	logger := &capturingLogger{}
+
+	u := User{ID: 7, TimeUsed: (maxFreeProcessingTimeSeconds - 1) * 1000}
+	if HandleRequestWithLogger(func() { time.Sleep(2 * time.Second) }, &u, logger) {
+		t.Error("Expected process exceeding the quota to be killed")
+	}
+	if HandleRequestWithLogger(func() {}, &u, logger) {
+		t.Error("Expected process of user without quota to be rejected")
+	}
+
+	expected := []string{
+		"UserID: 7\tFree processing time is almost over",
+		"UserID: 7\tFree processing time is over",
+		"UserID: 7\tFree processing time is over",
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.messages) != len(expected) {
+		t.Fatal("Unexpected messages", logger.messages)
+	}
+	for i, msg := range expected {
+		if logger.messages[i] != msg {
+			t.Errorf("Expected message %q, got %q", msg, logger.messages[i])
+		}
+	}
+}
+
+func TestHandleRequestRollingWindow(t *testing.T) {
+	u := User{ID: 0}
+	budget, window := time.Second, 2*time.Second
+
+	if HandleRequestRollingWindow(func() { time.Sleep(2 * time.Second) }, &u, budget, window) {
+		t.Fatal("Expected process exceeding the budget to be killed")
+	}
+	if HandleRequestRollingWindow(func() {}, &u, budget, window) {
+		t.Fatal("Expected process of user without budget in the window to be rejected")
+	}
+
+	// The used time falls out of the window
+	time.Sleep(window)
+	if !HandleRequestRollingWindow(func() { time.Sleep(500 * time.Millisecond) }, &u, budget, window) {
+		t.Error("Process killed although the window passed")
+	}
+	if used := timeUsed(&u); used < 1500*time.Millisecond {
+		t.Error("Expected all processing time to accumulate, got", used)
+	}
+}
+
+// fakeClock is a Clock which only moves forward on Advance
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	// created receives every new ticker, so a test knows when the
+	// quota checks started
+	created chan *fakeTicker
+}
+
+type fakeTicker struct {
+	clock  *fakeClock
+	c      chan time.Time
+	stop   chan struct{}
+	period time.Duration
+	next   time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0), created: make(chan *fakeTicker, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time), stop: make(chan struct{}), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	c.created <- t
+	return t
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			close(t.stop)
+			return
+		}
+	}
+}
+
+// Advance moves the clock forward by d, firing every tick on the way.
+// Each tick is delivered twice on the unbuffered channel: the second
+// send only succeeds once the check of the first one is complete,
+// unless the ticker got stopped meanwhile.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		var due *fakeTicker
+		for _, t := range c.tickers {
+			if !t.next.After(end) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = due.next
+		due.next = due.next.Add(due.period)
+		now := c.now
+		c.mu.Unlock()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case due.c <- now:
+			case <-due.stop:
+			}
+		}
+	}
+}
+
+func TestHandleRequestWithClock(t *testing.T) {
+	u := User{ID: 0}
+	clock := newFakeClock()
+
+	// The process would run for 20s, but only the fake clock moves
+	release := make(chan struct{})
+	defer close(release)
+	result := make(chan bool, 1)
+	go func() {
+		result <- HandleRequestWithClock(func() { <-release }, &u, clock)
+	}()
+	<-clock.created
+
+	clock.Advance(maxFreeProcessingTimeSeconds*time.Second - quotaCheckInterval)
+	select {
+	case <-result:
+		t.Fatal("Process killed before the budget was used up, used", timeUsed(&u))
+	default:
+	}
+
+	clock.Advance(quotaCheckInterval)
+	select {
+	case ok := <-result:
+		if ok {
+			t.Error("Expected process to be killed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Process not killed once the budget was used up")
+	}
+	if used := timeUsed(&u); used != maxFreeProcessingTimeSeconds*time.Second {
+		t.Error("Expected kill at exactly the budget, used", used)
+	}
+}
+
+func TestHandleRequestDowngradeToFree(t *testing.T) {
+	u := User{ID: 1, IsPremium: true, TimeUsed: maxFreeProcessingTimeSeconds * 1000}
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		DowngradeToFree(&u)
+	}()
+
+	// The running process is drained although the user has no quota
+	stats := HandleRequestWithStats(func() { time.Sleep(1500 * time.Millisecond) }, &u)
+	if stats.Killed {
+		t.Error("Process of downgraded user was killed instead of drained")
+	}
+	if !stats.Drained {
+		t.Error("Expected process of downgraded user to be drained")
+	}
+	if stats.RemainingBudget != 0 {
+		t.Error("Expected no budget left after downgrade, got", stats.RemainingBudget)
+	}
+
+	// New processes are not started anymore
+	if HandleRequest(func() {}, &u) {
+		t.Error("Expected process of downgraded user without quota to be rejected")
+	}
+
+	UpgradeToPremium(&u)
+	if stats := HandleRequestWithStats(func() {}, &u); stats.Killed || stats.Drained {
+		t.Error("Unexpected stats after upgrading again", stats)
+	}
+}
+
+func TestHandleRequestAfterDowngradeToFree(t *testing.T) {
+	u := User{ID: 1, IsPremium: true, TimeUsed: (maxFreeProcessingTimeSeconds - 1) * 1000}
+	DowngradeToFree(&u)
+
+	// A new process starts on the quota left and is killed like any free
+	// user's once it is used up
+	start := time.Now()
+	stats := HandleRequestWithStats(func() { time.Sleep(3 * time.Second) }, &u)
+	if !stats.Killed {
+		t.Error("Expected process started after downgrade to be killed")
+	}
+	if stats.Drained {
+		t.Error("Process started after downgrade was drained")
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > time.Second+300*time.Millisecond {
+		t.Error("Expected kill after the 1s quota left, got", elapsed)
+	}
+}
+
+func TestHandleRequestContextDeadline(t *testing.T) {
+	u := User{ID: 0, TimeUsed: (maxFreeProcessingTimeSeconds - 2) * 1000}
+
+	var deadline time.Time
+	var hasDeadline bool
+	process := func(ctx context.Context) {
+		deadline, hasDeadline = ctx.Deadline()
+		// Stop just before the quota is used up
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(deadline) - 300*time.Millisecond):
+		}
+	}
+
+	start := time.Now()
+	if !HandleRequestContext(process, &u) {
+		t.Error("Process stopping before its deadline was killed")
+	}
+	if !hasDeadline {
+		t.Fatal("Expected a deadline for a free user")
+	}
+	if remaining := deadline.Sub(start); remaining < 2*time.Second || remaining > 2100*time.Millisecond {
+		t.Error("Expected deadline 2s ahead for the quota left, got", remaining)
+	}
+
+	premium := User{ID: 1, IsPremium: true}
+	HandleRequestContext(func(ctx context.Context) {
+		_, hasDeadline = ctx.Deadline()
+	}, &premium)
+	if hasDeadline {
+		t.Error("Expected no deadline for a premium user")
+	}
+}
+
+func TestHandleRequestQueued(t *testing.T) {
+	u := User{ID: 0}
+	budget, window := time.Second, 2*time.Second
+
+	if HandleRequestRollingWindow(func() { time.Sleep(2 * time.Second) }, &u, budget, window) {
+		t.Fatal("Expected process exceeding the budget to be killed")
+	}
+
+	// The budget does not recover in time
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	ran := false
+	if _, err := HandleRequestQueued(ctx, func() { ran = true }, &u, budget, window); err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded while the budget is used up, got", err)
+	}
+	if ran {
+		t.Error("Queued process ran without budget")
+	}
+
+	// The budget recovers once the used time left the window
+	start := time.Now()
+	usedBefore := timeUsed(&u)
+	completed, err := HandleRequestQueued(context.Background(), func() { ran = true }, &u, budget, window)
+	if err != nil {
+		t.Fatal("Error HandleRequestQueued:", err)
+	}
+	if !completed || !ran {
+		t.Error("Queued process did not run after the budget recovered")
+	}
+	if charged := timeUsed(&u) - usedBefore; charged > 100*time.Millisecond {
+		t.Error("Expected the wait not to be charged, got", charged)
+	}
+	// The first charges of the killed process leave the window 2.1s
+	// after it started, which is about 900ms from now
+	if waited := time.Since(start); waited < 700*time.Millisecond {
+		t.Error("Queued process ran too early after", waited)
+	}
+}
+
+func TestHandleRequestInvalid(t *testing.T) {
+	killed := false
+	hooks := Hooks{OnKilled: func(*User) { killed = true }}
+
+	if HandleRequest(func() {}, nil) {
+		t.Error("Expected request without user to fail")
+	}
+	u := User{ID: 0}
+	if HandleRequest(nil, &u) {
+		t.Error("Expected request without process to fail")
+	}
+	if HandleRequestContext(nil, &u) {
+		t.Error("Expected context request without process to fail")
+	}
+	if HandleRequestWithHooks(nil, nil, hooks) || killed {
+		t.Error("Expected request without user and process to fail without hooks")
+	}
+	if completed := HandleRequestGroup([]func(){nil, func() {}}, &u); completed[0] || !completed[1] {
+		t.Error("Unexpected group result with a nil process", completed)
+	}
+	if _, err := HandleRequestQueued(context.Background(), func() {}, nil, time.Second, time.Second); err != ErrInvalidRequest {
+		t.Error("Expected ErrInvalidRequest for queued request without user, got", err)
+	}
+	if used := timeUsed(&u); used != 0 {
+		t.Error("Expected no time charged for invalid requests, got", used)
+	}
+}
+
+func TestHandleRequestWeighted(t *testing.T) {
+	u := User{ID: 0}
+
+	start := time.Now()
+	if HandleRequestWeighted(func() { time.Sleep(8 * time.Second) }, &u, 2) {
+		t.Error("Expected 8s process at 2x to be killed")
+	}
+	limit := maxFreeProcessingTimeSeconds * time.Second
+	if elapsed := time.Since(start); elapsed < limit/2 || elapsed > limit/2+300*time.Millisecond {
+		t.Error("Expected kill after 5s at 2x, got", elapsed)
+	}
+	if used := timeUsed(&u); used < limit || used > limit+2*quotaCheckInterval {
+		t.Error("Expected the full quota to be charged, got", used)
+	}
+}
+
+func TestHandleRequestWeightedInvalid(t *testing.T) {
+	for _, multiplier := range []float64{0, -1, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		u := User{ID: 0}
+		ran := false
+		if HandleRequestWeighted(func() { ran = true }, &u, multiplier) {
+			t.Error("Expected multiplier to be rejected:", multiplier)
+		}
+		if ran {
+			t.Error("Process ran with multiplier", multiplier)
+		}
+	}
+}
+
+// Jump moves the clock forward by d but fires every ticker only once,
+// like a ticker coalescing the ticks missed during a pause
+func (c *fakeClock) Jump(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	tickers := append([]*fakeTicker(nil), c.tickers...)
+	for _, t := range tickers {
+		t.next = now.Add(t.period)
+	}
+	c.mu.Unlock()
+
+	for _, t := range tickers {
+		for i := 0; i < 2; i++ {
+			select {
+			case t.c <- now:
+			case <-t.stop:
+			}
+		}
+	}
+}
+
+func TestHandleRequestCoalescedTicks(t *testing.T) {
+	u := User{ID: 0}
+	clock := newFakeClock()
+
+	release := make(chan struct{})
+	defer close(release)
+	result := make(chan bool, 1)
+	go func() {
+		result <- HandleRequestWithClock(func() { <-release }, &u, clock)
+	}()
+	<-clock.created
+
+	// A single tick after almost the whole budget passed
+	clock.Jump(maxFreeProcessingTimeSeconds*time.Second - 50*time.Millisecond)
+	select {
+	case <-result:
+		t.Fatal("Process killed before the budget was used up, used", timeUsed(&u))
+	default:
+	}
+	if used := timeUsed(&u); used != maxFreeProcessingTimeSeconds*time.Second-50*time.Millisecond {
+		t.Error("Expected the time since the start to be charged on the coalesced tick, got", used)
+	}
+
+	clock.Jump(50 * time.Millisecond)
+	select {
+	case ok := <-result:
+		if ok {
+			t.Error("Expected process to be killed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Process not killed once the budget was used up")
+	}
+	if used := timeUsed(&u); used != maxFreeProcessingTimeSeconds*time.Second {
+		t.Error("Expected kill at exactly the budget, used", used)
+	}
+}
+
+func TestRemainingBudget(t *testing.T) {
+	u := User{ID: 0}
+	limit := maxFreeProcessingTimeSeconds * time.Second
+
+	if remaining := RemainingBudget(&u); remaining != limit {
+		t.Error("Expected the full budget for a new user, got", remaining)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		HandleRequest(func() { time.Sleep(1500 * time.Millisecond) }, &u)
+		close(done)
+	}()
+	time.Sleep(time.Second)
+	if remaining := RemainingBudget(&u); remaining > limit-900*time.Millisecond || remaining < limit-1100*time.Millisecond {
+		t.Error("Expected about 9s left while the request runs, got", remaining)
+	}
+	<-done
+	if remaining := RemainingBudget(&u); remaining > limit-1500*time.Millisecond || remaining < limit-1600*time.Millisecond {
+		t.Error("Expected about 8.5s left after the request, got", remaining)
+	}
+
+	u.TimeUsed = 2 * maxFreeProcessingTimeSeconds * 1000
+	if remaining := RemainingBudget(&u); remaining != 0 {
+		t.Error("Expected no budget left when over the quota, got", remaining)
+	}
+
+	premium := User{ID: 1, IsPremium: true}
+	if remaining := RemainingBudget(&premium); remaining != unlimitedBudget {
+		t.Error("Expected unlimited budget for premium user, got", remaining)
+	}
+}
+
+func TestHandleRequestContextWithStatsForced(t *testing.T) {
+	// Little quota left, so the process gets killed on the first check
+	u := User{ID: 0, TimeUsed: maxFreeProcessingTimeSeconds*1000 - 50}
+
+	release := make(chan struct{})
+	defer close(release)
+	stats := HandleRequestContextWithStats(func(ctx context.Context) {
+		// Ignores the cancellation
+		<-release
+	}, &u)
+	if !stats.Killed || !stats.Forced {
+		t.Error("Expected a process ignoring its context to be reported as forced", stats)
+	}
+	if stats.Elapsed > time.Second {
+		t.Error("Expected the kill to be reported after the grace period", stats.Elapsed)
+	}
+
+	ResetUserQuota(&u)
+	atomic.StoreInt64(&u.TimeUsed, maxFreeProcessingTimeSeconds*1000-50)
+	stats = HandleRequestContextWithStats(func(ctx context.Context) {
+		// Takes a while to stop, but within the grace period
+		<-ctx.Done()
+		time.Sleep(200 * time.Millisecond)
+	}, &u)
+	if !stats.Killed || stats.Forced {
+		t.Error("Expected a process honoring its context not to be forced", stats)
+	}
+
+	stats = HandleRequestContextWithStats(func(ctx context.Context) {}, &User{ID: 1})
+	if stats.Killed || stats.Forced {
+		t.Error("Expected a completed process to be neither killed nor forced", stats)
+	}
+}
+
+func TestHandleRequestE(t *testing.T) {
+	u := User{ID: 0}
+	elapsed, err := HandleRequestE(func() { time.Sleep(200 * time.Millisecond) }, &u)
+	if err != nil {
+		t.Error("Expected no error for a completed process, got", err)
+	}
+	if elapsed < 200*time.Millisecond {
+		t.Error("Expected elapsed time of the process, got", elapsed)
+	}
+
+	atomic.StoreInt64(&u.TimeUsed, maxFreeProcessingTimeSeconds*1000)
+	if _, err := HandleRequestE(func() {}, &u); err != ErrTimeLimitExceeded {
+		t.Error("Expected ErrTimeLimitExceeded for an over-budget user, got", err)
+	}
+
+	if _, err := HandleRequestE(nil, &u); err != ErrInvalidRequest {
+		t.Error("Expected ErrInvalidRequest without process, got", err)
+	}
+}
+
+func TestHandleRequestWithProgress(t *testing.T) {
+	// One second of quota left
+	u := User{ID: 0, TimeUsed: (maxFreeProcessingTimeSeconds - 1) * 1000}
+
+	progress, wait := HandleRequestWithProgress(func() { time.Sleep(3 * time.Second) }, &u)
+
+	var values []time.Duration
+	for elapsed := range progress {
+		values = append(values, elapsed)
+	}
+	if wait() {
+		t.Error("Expected process exceeding the budget to be killed")
+	}
+
+	if len(values) < 5 {
+		t.Fatal("Expected progress on every quota check, got", values)
+	}
+	for i := 1; i < len(values); i++ {
+		if values[i] <= values[i-1] {
+			t.Error("Expected progress to increase monotonically", values)
+			break
+		}
+	}
+	if last := values[len(values)-1]; last < 900*time.Millisecond || last > 1200*time.Millisecond {
+		t.Error("Expected progress up to the budget left, got", last)
+	}
+}
+
+func TestHandleRequestWithWarmup(t *testing.T) {
+	u := User{ID: 0}
+
+	// Scaled down from a 5s warm-up with a 3s budget
+	const warmup = time.Second
+	const budget = 300 * time.Millisecond
+
+	start := time.Now()
+	var started time.Time
+	completed := HandleRequestWithWarmup(func(startProcessing func()) {
+		time.Sleep(warmup)
+		started = time.Now()
+		startProcessing()
+		time.Sleep(2 * time.Second)
+	}, &u, budget)
+	killedAfter := time.Since(start)
+
+	if completed {
+		t.Fatal("Expected process exceeding the budget after warm-up to be killed")
+	}
+	if killedAfter < warmup {
+		t.Fatal("Expected the process not to be killed during warm-up", killedAfter)
+	}
+	if processing := killedAfter - started.Sub(start); processing < budget || processing > budget+200*time.Millisecond {
+		t.Error("Expected the kill one budget after StartProcessing, got", processing)
+	}
+	if used := timeUsed(&u); used > budget+200*time.Millisecond {
+		t.Error("Expected warm-up not to be charged, got", used)
+	}
+}
+
+func TestHandleRequestPanic(t *testing.T) {
+	u := User{ID: 7}
+
+	stats := HandleRequestWithStats(func() {
+		time.Sleep(300 * time.Millisecond)
+		panic("corrupt video")
+	}, &u)
+	if !stats.Failed || stats.Killed || stats.Completed() {
+		t.Error("Expected a panicking process to fail rather than be killed or complete", stats)
+	}
+	if used := timeUsed(&u); used < 300*time.Millisecond {
+		t.Error("Expected the time until the panic to be charged, got", used)
+	}
+
+	logger := &capturingLogger{}
+	if HandleRequestWithLogger(func() { panic("corrupt video") }, &u, logger) {
+		t.Error("Expected a panicking process not to complete")
+	}
+	if len(logger.messages) != 1 || logger.messages[0] != "UserID: 7\tProcess panicked: corrupt video" {
+		t.Error("Expected the panic to be logged, got", logger.messages)
+	}
+
+	if _, err := HandleRequestE(func() { panic("corrupt video") }, &u); err != ErrProcessPanicked {
+		t.Error("Expected ErrProcessPanicked, got", err)
+	}
+}
+
+func TestHandleRequestWithContextCancelled(t *testing.T) {
+	u := User{ID: 0}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// Scaled down from cancelling at 3s of the 10s budget
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	processCancelled := make(chan struct{})
+	start := time.Now()
+	completed, err := HandleRequestWithContext(ctx, func(ctx context.Context) {
+		<-ctx.Done()
+		close(processCancelled)
+	}, &u)
+	elapsed := time.Since(start)
+
+	if completed || err != context.Canceled {
+		t.Error("Expected the request to be cancelled by the caller", completed, err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Error("Expected the request to return promptly on cancel", elapsed)
+	}
+	select {
+	case <-processCancelled:
+	case <-time.After(time.Second):
+		t.Error("Expected the context of the process to be cancelled")
+	}
+	if used := timeUsed(&u); used < 300*time.Millisecond || used > 500*time.Millisecond {
+		t.Error("Expected the time until the cancel to be charged, got", used)
+	}
+
+	if completed, err := HandleRequestWithContext(context.Background(), func(context.Context) {}, &u); !completed || err != nil {
+		t.Error("Expected a request which is not cancelled to complete", completed, err)
+	}
+}
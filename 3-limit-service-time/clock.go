@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// Clock is the source of time for handling requests. It defaults to
+// the real time package, tests may replace it to simulate long running
+// processes without waiting for them.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker used for the quota checks
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock implements Clock with the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker implements Ticker with a time.Ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
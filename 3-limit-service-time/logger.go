@@ -0,0 +1,12 @@
+package main
+
+// Logger receives the messages about requests of free users reaching
+// their limit, a *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// nopLogger discards every message, it is the default Logger
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
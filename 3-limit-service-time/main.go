@@ -10,19 +10,658 @@
 
 package main
 
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxFreeProcessingTimeSeconds is the processing time a free user
+	// gets in total, accumulated over all of the user's requests
+	maxFreeProcessingTimeSeconds = 10
+	// quotaCheckInterval is how often a running process is checked
+	// against the user's quota
+	quotaCheckInterval = 100 * time.Millisecond
+	// approachingLimitPercent is the share of the limit after which a
+	// free user's process is warned that it is going to be killed
+	approachingLimitPercent = 80
+	// killGracePeriod is how long a killed process gets to return after
+	// its context got cancelled before it is reported as forced
+	killGracePeriod = 500 * time.Millisecond
+)
+
 // User defines the UserModel. Use this to check whether a User is a
-// Premium user or not
+// Premium user or not. IsPremium must not change once the user is
+// shared, use UpgradeToPremium and DowngradeToFree to change users
+// with running requests.
 type User struct {
 	ID        int
 	IsPremium bool
-	TimeUsed  int64 // in seconds
+	TimeUsed  int64 // in milliseconds, accessed atomically
+
+	upgraded   atomic.Bool
+	downgraded atomic.Bool
+	usage      usageLog
 }
 
 // HandleRequest runs the processes requested by users. Returns false
-// if process had to be killed
+// if process had to be killed or panicked. A plain func() cannot be
+// interrupted, so a killed process keeps running in the background,
+// use HandleRequestContext for processes which can stop.
 func HandleRequest(process func(), u *User) bool {
-	process()
-	return true
+	_, err := HandleRequestE(process, u)
+	return err == nil
+}
+
+// HandleRequestE is like HandleRequest but returns how long the process
+// ran and why it did not complete: ErrTimeLimitExceeded if it had to
+// be killed or was not started because the user has no quota left,
+// ErrProcessPanicked if it panicked and ErrInvalidRequest if the user
+// or the process is missing.
+func HandleRequestE(process func(), u *User) (time.Duration, error) {
+	if process == nil || u == nil {
+		return 0, ErrInvalidRequest
+	}
+
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	stats := r.handle(withoutContext(process), u)
+	if stats.Killed {
+		return stats.Elapsed, ErrTimeLimitExceeded
+	}
+	if stats.Failed {
+		return stats.Elapsed, ErrProcessPanicked
+	}
+	return stats.Elapsed, nil
+}
+
+// HandleRequestContext is like HandleRequest but cancels the context
+// passed to process once the process is killed, so that it can stop.
+// For free users the context carries the deadline at which the quota
+// left is used up, so the process can plan its work with
+// ctx.Deadline(). Other requests of the same user running meanwhile
+// use up the quota earlier, the process is killed then anyway.
+func HandleRequestContext(process func(ctx context.Context), u *User) bool {
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	r.withDeadline = true
+	return r.handle(process, u).Completed()
+}
+
+// HandleRequestWithContext is like HandleRequestContext but the caller
+// may cancel the request early with ctx, e.g. when the user clicked
+// cancel. It then stops charging time right away, cancels the context
+// passed to process and returns ctx.Err(), which tells a cancelled
+// request apart from a killed one. Otherwise it returns whether the
+// process completed.
+func HandleRequestWithContext(ctx context.Context, process func(ctx context.Context), u *User) (bool, error) {
+	if process == nil || u == nil {
+		return false, ErrInvalidRequest
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	r.withDeadline = true
+	r.parent = ctx
+	stats := r.handle(process, u)
+	if stats.Cancelled {
+		return false, ctx.Err()
+	}
+	return stats.Completed(), nil
+}
+
+// HandleRequestWithLimit is like HandleRequest but kills the process
+// once the user used limit in total instead of the default free quota.
+// The limit may be shorter than a second.
+func HandleRequestWithLimit(process func(), u *User, limit time.Duration) bool {
+	return newRequest(limit).handle(withoutContext(process), u).Completed()
+}
+
+// HandleRequestWithWarmup is like HandleRequestWithLimit but does not
+// charge the warm-up of the process: the time only starts counting
+// against the limit once the process calls startProcessing, and it
+// cannot be killed before. Calling startProcessing more than once has
+// no effect.
+func HandleRequestWithWarmup(process func(startProcessing func()), u *User, limit time.Duration) bool {
+	if process == nil {
+		return newRequest(limit).handle(nil, u).Completed()
+	}
+
+	r := newRequest(limit)
+	r.watch.Pause()
+	return r.handle(func(context.Context) { process(r.watch.Resume) }, u).Completed()
+}
+
+// HandleRequestGroup runs the processes of a user concurrently, all of
+// them sharing the user's free quota. Once their combined processing
+// time used up the quota, every process of the group still running
+// gets killed. The result reports for every process whether it
+// completed, in the order of processes.
+func HandleRequestGroup(processes []func(), u *User) []bool {
+	completed := make([]bool, len(processes))
+
+	var wg sync.WaitGroup
+	for i, process := range processes {
+		wg.Add(1)
+		go func(i int, process func()) {
+			defer wg.Done()
+			completed[i] = HandleRequest(process, u)
+		}(i, process)
+	}
+	wg.Wait()
+
+	return completed
+}
+
+// HandleRequestWithClock is like HandleRequest but takes the time from
+// clock instead of the real time, e.g. to simulate a long process in a
+// test without waiting for it
+func HandleRequestWithClock(process func(), u *User, clock Clock) bool {
+	r := newRequestWithClock(maxFreeProcessingTimeSeconds*time.Second, clock)
+	return r.handle(withoutContext(process), u).Completed()
+}
+
+// HandleRequestWeighted is like HandleRequest but charges multiplier
+// times the processing time to the user, e.g. 2 for GPU jobs which use
+// up the quota twice as fast. A multiplier which is not positive or not
+// finite is rejected without running process.
+func HandleRequestWeighted(process func(), u *User, multiplier float64) bool {
+	if !(multiplier > 0) || math.IsInf(multiplier, 1) {
+		return false
+	}
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	r.multiplier = multiplier
+	return r.handle(withoutContext(process), u).Completed()
+}
+
+// HandleRequestRollingWindow is like HandleRequestWithLimit but only
+// counts the processing time the user used within the last window
+// against the budget, so the quota renews over time instead of being
+// used up for good. TimeUsed still accumulates all processing time.
+func HandleRequestRollingWindow(process func(), u *User, budget, window time.Duration) bool {
+	r := newRequest(budget)
+	r.window = window
+	return r.handle(withoutContext(process), u).Completed()
+}
+
+// HandleRequestQueued is like HandleRequestRollingWindow but rather
+// than rejecting a user without budget left, it waits until enough of
+// the used time fell out of the window and runs process then. It
+// returns ctx.Err() if the context is done before, otherwise whether
+// the process completed. Once started the process is killed like any
+// other when it uses up the budget.
+func HandleRequestQueued(ctx context.Context, process func(), u *User, budget, window time.Duration) (bool, error) {
+	if process == nil || u == nil {
+		return false, ErrInvalidRequest
+	}
+
+	r := newRequest(budget)
+	r.window = window
+
+	if !isPremium(u) && r.used(u, 0) >= r.limit {
+		ticker := r.clock.NewTicker(quotaCheckInterval)
+		defer ticker.Stop()
+
+		for !isPremium(u) && r.used(u, 0) >= r.limit {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-ticker.C():
+			}
+		}
+		// Only the time the process runs is charged, not the wait
+		r.watch = newStopwatch(r.clock)
+	}
+
+	return r.handle(withoutContext(process), u).Completed(), nil
+}
+
+// RequestStats describes how a request was processed
+type RequestStats struct {
+	// Elapsed is how long the process ran
+	Elapsed time.Duration
+	// Killed reports whether the process had to be killed
+	Killed bool
+	// RemainingBudget is the quota the user has left afterwards, it is
+	// unlimitedBudget for premium users
+	RemainingBudget time.Duration
+	// Drained reports whether the user was downgraded to a free user
+	// while the process ran, which then was allowed to finish anyway
+	Drained bool
+	// Forced reports whether a killed process ignored the cancellation
+	// of its context and did not return within killGracePeriod. A
+	// goroutine cannot be stopped from outside, so it keeps running in
+	// the background.
+	Forced bool
+	// Failed reports whether the process panicked, the time it ran is
+	// charged anyway
+	Failed bool
+	// Cancelled reports whether the caller cancelled the request before
+	// the process returned
+	Cancelled bool
+}
+
+// Completed reports whether the process ran to its end, i.e. it was
+// neither killed, panicked nor cancelled
+func (s RequestStats) Completed() bool {
+	return !s.Killed && !s.Failed && !s.Cancelled
+}
+
+// unlimitedBudget is the remaining budget of premium users
+const unlimitedBudget = time.Duration(math.MaxInt64)
+
+// HandleRequestWithStats is like HandleRequest but reports how long
+// the process ran and how much quota the user has left
+func HandleRequestWithStats(process func(), u *User) RequestStats {
+	return newRequest(maxFreeProcessingTimeSeconds*time.Second).handle(withoutContext(process), u)
+}
+
+// HandleRequestContextWithStats is like HandleRequestContext but
+// reports how the process ran. A killed process gets killGracePeriod
+// to return after its context got cancelled, if it does not the stats
+// report it as forced, so sticky processes can be detected.
+func HandleRequestContextWithStats(process func(ctx context.Context), u *User) RequestStats {
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	r.withDeadline = true
+	r.grace = killGracePeriod
+	return r.handle(process, u)
+}
+
+// HandleRequestWithProgress starts process in the background like
+// HandleRequest. The returned channel receives how long the process ran
+// on every quota check and is closed once the request is done, the
+// returned func blocks until then and returns false if the process had
+// to be killed. Progress is dropped while the channel is full, so a
+// slow reader never delays the kill.
+func HandleRequestWithProgress(process func(), u *User) (<-chan time.Duration, func() bool) {
+	limit := maxFreeProcessingTimeSeconds * time.Second
+	// Room for every check of a request using up the whole quota
+	progress := make(chan time.Duration, limit/quotaCheckInterval)
+
+	r := newRequest(limit)
+	r.progress = progress
+
+	done := make(chan struct{})
+	var completed bool
+	go func() {
+		completed = r.handle(withoutContext(process), u).Completed()
+		close(progress)
+		close(done)
+	}()
+
+	return progress, func() bool {
+		<-done
+		return completed
+	}
+}
+
+// PausableRequest controls a request started by HandleRequestPausable
+type PausableRequest struct {
+	watch  *stopwatch
+	result chan bool
+}
+
+// HandleRequestPausable starts process in the background like
+// HandleRequestWithLimit, but the returned PausableRequest allows to
+// pause the time accounting, e.g. while the process waits for an
+// external dependency. A paused process is never killed.
+func HandleRequestPausable(process func(), u *User, limit time.Duration) *PausableRequest {
+	req := newRequest(limit)
+	r := &PausableRequest{
+		watch:  req.watch,
+		result: make(chan bool, 1),
+	}
+	go func() {
+		r.result <- req.handle(withoutContext(process), u).Completed()
+	}()
+	return r
+}
+
+// Pause stops charging processing time to the user
+func (r *PausableRequest) Pause() {
+	r.watch.Pause()
+}
+
+// Resume charges processing time to the user again
+func (r *PausableRequest) Resume() {
+	r.watch.Resume()
+}
+
+// Wait blocks until the request is done and returns false if the
+// process had to be killed. It must be called only once.
+func (r *PausableRequest) Wait() bool {
+	return <-r.result
+}
+
+// timeUsed returns the processing time the user used so far
+func timeUsed(u *User) time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.TimeUsed)) * time.Millisecond
+}
+
+// RemainingBudget returns the free processing time the user has left,
+// or unlimitedBudget for premium users. It is safe to call while
+// requests of the user are running, their time is charged on every
+// quota check.
+func RemainingBudget(u *User) time.Duration {
+	if isPremium(u) {
+		return unlimitedBudget
+	}
+	remaining := maxFreeProcessingTimeSeconds*time.Second - timeUsed(u)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// ResetUserQuota gives the user the full free quota again, e.g. at the
+// start of a billing cycle. Requests running meanwhile only charge the
+// time they use after the reset.
+func ResetUserQuota(u *User) {
+	atomic.StoreInt64(&u.TimeUsed, 0)
+	u.usage.reset()
+}
+
+// UpgradeToPremium makes u a premium user. It is safe to call while
+// requests of the user are running, they stop enforcing the limit on
+// their next quota check.
+func UpgradeToPremium(u *User) {
+	u.downgraded.Store(false)
+	u.upgraded.Store(true)
+}
+
+// DowngradeToFree makes u a free user, e.g. when the subscription
+// lapsed. It is safe to call while requests of the user are running,
+// those are drained: they may finish without being killed, but new
+// requests are handled like the ones of any free user. So they start
+// while the user has free quota left, including time used while
+// premium, and get killed once it is used up, or they are rejected if
+// the user has no quota left.
+func DowngradeToFree(u *User) {
+	u.upgraded.Store(false)
+	u.downgraded.Store(true)
+}
+
+// isPremium reports whether u is a premium user or got upgraded to one
+// and not downgraded since
+func isPremium(u *User) bool {
+	return (u.IsPremium || u.upgraded.Load()) && !u.downgraded.Load()
+}
+
+// Hooks are optional callbacks invoked while handling a request
+type Hooks struct {
+	// OnKilled is called once when the process of a free user gets
+	// killed or is not even started because the user has no quota left
+	OnKilled func(u *User)
+	// OnApproachingLimit is called at most once per request when a free
+	// user used approachingLimitPercent of the limit, so the process can
+	// checkpoint before it gets killed
+	OnApproachingLimit func(u *User)
+}
+
+// HandleRequestWithHooks is like HandleRequest but invokes the given
+// hooks
+func HandleRequestWithHooks(process func(), u *User, hooks Hooks) bool {
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	r.hooks = hooks
+	return r.handle(withoutContext(process), u).Completed()
+}
+
+// HandleRequestWithLogger is like HandleRequest but reports free users
+// approaching and reaching their limit to logger
+func HandleRequestWithLogger(process func(), u *User, logger Logger) bool {
+	r := newRequest(maxFreeProcessingTimeSeconds * time.Second)
+	r.logger = logger
+	return r.handle(withoutContext(process), u).Completed()
+}
+
+// request configures how a process is handled
+type request struct {
+	// limit is the processing time a free user may use in total
+	limit time.Duration
+	// window is the rolling window the limit applies to, zero means the
+	// limit applies to all processing time ever used
+	window time.Duration
+	// watch measures the processing time charged to the user
+	watch *stopwatch
+	// multiplier scales the processing time before it is charged
+	multiplier float64
+	hooks      Hooks
+	logger     Logger
+	clock      Clock
+	// withDeadline attaches the deadline of free users to the context
+	// of the process
+	withDeadline bool
+	// grace is how long a killed process is waited for to return, zero
+	// means it is not waited for at all
+	grace time.Duration
+	// progress receives the processing time on every check if set
+	progress chan<- time.Duration
+	// parent lets the caller cancel the request, nil means it cannot
+	parent context.Context
+}
+
+// newRequest creates a request with the given limit on the real clock,
+// no hooks and no logging
+func newRequest(limit time.Duration) request {
+	return newRequestWithClock(limit, realClock{})
+}
+
+// newRequestWithClock is like newRequest but takes the time from clock
+func newRequestWithClock(limit time.Duration, clock Clock) request {
+	return request{
+		limit:      limit,
+		watch:      newStopwatch(clock),
+		multiplier: 1,
+		logger:     nopLogger{},
+		clock:      clock,
+	}
+}
+
+// ErrTimeLimitExceeded returned when a free user used up the
+// processing time
+var ErrTimeLimitExceeded = errors.New("Free processing time is over")
+
+// ErrProcessPanicked returned when the process panicked
+var ErrProcessPanicked = errors.New("Process panicked")
+
+// ErrInvalidRequest returned when a request misses the user or the
+// process
+var ErrInvalidRequest = errors.New("Request needs a user and a process")
+
+// withoutContext adapts a process which ignores the context to handle,
+// a nil process stays nil
+func withoutContext(process func()) func(ctx context.Context) {
+	if process == nil {
+		return nil
+	}
+	return func(context.Context) { process() }
+}
+
+// handle runs process and kills it once free user u used the limit
+// processing time in total. A request without user or process is
+// reported as killed without running anything.
+func (r request) handle(process func(ctx context.Context), u *User) RequestStats {
+	if process == nil || u == nil {
+		return RequestStats{Killed: true}
+	}
+
+	// No quota left, do not even start the process
+	if !isPremium(u) && r.used(u, 0) >= r.limit {
+		r.killed(u)
+		return RequestStats{Killed: true}
+	}
+
+	parent := r.parent
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	// quotaCtx ends at the deadline of the quota left, if there is one
+	var quotaCtx context.Context
+	if r.withDeadline && !isPremium(u) {
+		ctx, cancel = context.WithDeadline(ctx, time.Now().Add(r.limit-r.used(u, 0)))
+		defer cancel()
+		quotaCtx = ctx
+	}
+
+	start := r.clock.Now()
+	// Processes of premium users are drained rather than killed when
+	// the user gets downgraded meanwhile
+	startedPremium := isPremium(u)
+	// Closing rather than sending on doneCh never blocks, so the
+	// process goroutine exits even if the process got killed. A panic
+	// is recovered there, otherwise it would crash the program.
+	doneCh := make(chan struct{})
+	var panicked interface{}
+	go func() {
+		defer close(doneCh)
+		defer func() {
+			panicked = recover()
+		}()
+		process(ctx)
+	}()
+
+	// The ticker only wakes up the checks, the time charged is measured
+	// by the watch on the monotonic clock, so the limit holds even if
+	// ticks get delayed or coalesced, e.g. under load
+	ticker := r.clock.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+
+	// The time on the watch, scaled by the multiplier, is charged to
+	// the user with millisecond precision on every check, premium users
+	// are tracked as well but never killed. Concurrent requests of the
+	// same user charge the same counter, so they share the quota.
+	var charged int64
+	warned := false
+	charge := func() time.Duration {
+		elapsed := int64(float64(r.watch.Elapsed()/time.Millisecond) * r.multiplier)
+		delta := elapsed - charged
+		atomic.AddInt64(&u.TimeUsed, delta)
+		charged = elapsed
+		return r.used(u, time.Duration(delta)*time.Millisecond)
+	}
+
+	for {
+		select {
+		case <-doneCh:
+			used := charge()
+			stats := RequestStats{Elapsed: r.clock.Now().Sub(start)}
+			if panicked != nil {
+				stats.Failed = true
+				r.logger.Printf("UserID: %d\tProcess panicked: %v", u.ID, panicked)
+			}
+			// The process may return on the cancel before parent.Done
+			// is selected
+			if parent.Err() != nil {
+				stats.Cancelled = true
+				return stats
+			}
+			premium := isPremium(u)
+			stats.Drained = startedPremium && !premium
+			// A process honouring its deadline returns before the next
+			// check would have killed it, it still used up the quota
+			if !startedPremium && !premium && (used >= r.limit || r.quotaExpired(quotaCtx, parent)) {
+				r.killed(u)
+				stats.Killed = true
+				return stats
+			}
+			switch {
+			case premium:
+				stats.RemainingBudget = unlimitedBudget
+			case used < r.limit:
+				stats.RemainingBudget = r.limit - used
+			}
+			return stats
+		case <-parent.Done():
+			charge()
+			return RequestStats{Elapsed: r.clock.Now().Sub(start), Cancelled: true}
+		case <-ticker.C():
+			used := charge()
+			r.reportProgress()
+			// Users upgraded meanwhile are no longer killed
+			if startedPremium || isPremium(u) {
+				continue
+			}
+			if used >= r.limit {
+				r.killed(u)
+				stats := RequestStats{Elapsed: r.clock.Now().Sub(start), Killed: true}
+				cancel()
+				stats.Forced = !r.waitReturned(doneCh)
+				return stats
+			}
+			if !warned && used >= r.limit/100*approachingLimitPercent {
+				warned = true
+				r.approachingLimit(u)
+			}
+		}
+	}
+}
+
+// quotaExpired reports whether quotaCtx ended at the deadline of the
+// quota left rather than with the parent context
+func (r request) quotaExpired(quotaCtx, parent context.Context) bool {
+	return quotaCtx != nil && quotaCtx.Err() == context.DeadlineExceeded && parent.Err() == nil
+}
+
+// waitReturned waits up to the grace period for a killed process to
+// return and reports whether it did
+func (r request) waitReturned(doneCh <-chan struct{}) bool {
+	if r.grace <= 0 {
+		return true
+	}
+
+	ticker := r.clock.NewTicker(r.grace)
+	defer ticker.Stop()
+
+	select {
+	case <-doneCh:
+		return true
+	case <-ticker.C():
+		return false
+	}
+}
+
+// reportProgress sends the processing time so far on the progress
+// channel, it drops it if the channel is full
+func (r request) reportProgress() {
+	if r.progress == nil {
+		return
+	}
+	select {
+	case r.progress <- r.watch.Elapsed():
+	default:
+	}
+}
+
+// used records charged as used by u right now and returns the
+// processing time counting against the limit
+func (r request) used(u *User, charged time.Duration) time.Duration {
+	if r.window > 0 {
+		return u.usage.add(r.clock.Now(), charged, r.window)
+	}
+	return timeUsed(u)
+}
+
+// killed logs the kill and invokes the OnKilled hook if there is one
+func (r request) killed(u *User) {
+	r.logger.Printf("UserID: %d\tFree processing time is over", u.ID)
+	if r.hooks.OnKilled != nil {
+		r.hooks.OnKilled(u)
+	}
+}
+
+// approachingLimit logs the warning and invokes the
+// OnApproachingLimit hook if there is one
+func (r request) approachingLimit(u *User) {
+	r.logger.Printf("UserID: %d\tFree processing time is almost over", u.ID)
+	if r.hooks.OnApproachingLimit != nil {
+		r.hooks.OnApproachingLimit(u)
+	}
 }
 
 func main() {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// stopwatch measures the processing time which is charged to a user.
+// It starts running on creation and stands still while paused.
+type stopwatch struct {
+	clock   Clock
+	mu      sync.Mutex
+	elapsed time.Duration
+	started time.Time
+	paused  bool
+}
+
+func newStopwatch(clock Clock) *stopwatch {
+	return &stopwatch{clock: clock, started: clock.Now()}
+}
+
+// Elapsed returns the time the stopwatch was running
+func (s *stopwatch) Elapsed() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		return s.elapsed
+	}
+	return s.elapsed + s.clock.Now().Sub(s.started)
+}
+
+// Pause stops the stopwatch, pausing twice has no effect
+func (s *stopwatch) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.paused {
+		s.elapsed += s.clock.Now().Sub(s.started)
+		s.paused = true
+	}
+}
+
+// Resume restarts a paused stopwatch
+func (s *stopwatch) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		s.started = s.clock.Now()
+		s.paused = false
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// usageLog records when processing time was charged to a user, so the
+// usage within a rolling window can be summed up
+type usageLog struct {
+	mu      sync.Mutex
+	entries []usageEntry
+}
+
+// usageEntry is processing time charged at a point in time
+type usageEntry struct {
+	at   time.Time
+	used time.Duration
+}
+
+// add records used at now and returns the usage within the window
+// ending at now. Entries which fell out of the window are dropped.
+func (l *usageLog) add(now time.Time, used, window time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if used > 0 {
+		l.entries = append(l.entries, usageEntry{at: now, used: used})
+	}
+
+	start := now.Add(-window)
+	i := 0
+	for i < len(l.entries) && !l.entries[i].at.After(start) {
+		i++
+	}
+	l.entries = l.entries[i:]
+
+	var total time.Duration
+	for _, e := range l.entries {
+		total += e.used
+	}
+	return total
+}
+
+// reset drops every entry
+func (l *usageLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = nil
+}
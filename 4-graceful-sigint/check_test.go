@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeProcess runs until Stop is called or its context is cancelled,
+// it is done once release is closed
+type fakeProcess struct {
+	release chan struct{}
+	stopped chan struct{}
+	running chan struct{}
+	done    chan struct{}
+}
+
+func newFakeProcess() *fakeProcess {
+	return &fakeProcess{
+		release: make(chan struct{}),
+		stopped: make(chan struct{}),
+		running: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (p *fakeProcess) Run(ctx context.Context) {
+	close(p.running)
+	<-ctx.Done()
+	close(p.stopped)
+	<-p.release
+	close(p.done)
+}
+
+func (p *fakeProcess) Stop() {
+	close(p.stopped)
+	<-p.release
+	close(p.done)
+}
+
+func (p *fakeProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+func TestGracefulShutdownStopped(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	sig <- os.Interrupt
+
+	if !GracefulShutdown(proc, time.Second, sig) {
+		t.Error("Expected graceful shutdown when Stop returns")
+	}
+}
+
+func TestGracefulShutdownSecondSignal(t *testing.T) {
+	proc := newFakeProcess()
+	defer close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	sig <- os.Interrupt
+	go func() {
+		<-proc.stopped
+		sig <- os.Interrupt
+	}()
+
+	if GracefulShutdown(proc, time.Minute, sig) {
+		t.Error("Expected forced shutdown on second signal")
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	proc := newFakeProcess()
+	defer close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	sig <- os.Interrupt
+
+	start := time.Now()
+	if GracefulShutdown(proc, 100*time.Millisecond, sig) {
+		t.Error("Expected forced shutdown when Stop hangs")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Forced shutdown too late after", elapsed)
+	}
+}
+
+func TestWaitForShutdownAll(t *testing.T) {
+	procs := []*fakeProcess{newFakeProcess(), newFakeProcess(), newFakeProcess()}
+	processes := make([]Process, len(procs))
+	for i, proc := range procs {
+		processes[i] = proc
+	}
+
+	// The first two stop right away, the last one is slow
+	close(procs[0].release)
+	close(procs[1].release)
+	go func() {
+		<-procs[2].stopped
+		time.Sleep(100 * time.Millisecond)
+		close(procs[2].release)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		for _, proc := range procs {
+			<-proc.running
+		}
+		sig <- os.Interrupt
+	}()
+
+	cleanedUp := false
+	hook := func(context.Context) error {
+		for i, proc := range procs {
+			select {
+			case <-proc.done:
+			default:
+				t.Error("Cleanup hook run before process", i, "was done")
+			}
+		}
+		cleanedUp = true
+		return nil
+	}
+	if code := WaitForShutdownWithPolicy(context.Background(), sig, processes, DefaultSignalPolicy, hook); code != exitGraceful {
+		t.Error("Expected graceful exit code once all processes stopped, got", code)
+	}
+	if !cleanedUp {
+		t.Error("Cleanup hook not run after all processes stopped")
+	}
+}
+
+func TestWaitForShutdownAllTimeout(t *testing.T) {
+	procs := []*fakeProcess{newFakeProcess(), newFakeProcess(), newFakeProcess()}
+	processes := make([]Process, len(procs))
+	for i, proc := range procs {
+		processes[i] = proc
+	}
+
+	// The last one never stops
+	close(procs[0].release)
+	close(procs[1].release)
+	defer close(procs[2].release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		for _, proc := range procs {
+			<-proc.running
+		}
+		sig <- os.Interrupt
+	}()
+
+	hookRun := false
+	hook := func(context.Context) error {
+		hookRun = true
+		return nil
+	}
+	start := time.Now()
+	if code := waitForShutdown(context.Background(), sig, processes, DefaultSignalPolicy, 200*time.Millisecond, []CleanupHook{hook}); code != exitTimeout {
+		t.Error("Expected timeout exit code, got", code)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Error("Expected shutdown to time out after 200ms, took", elapsed)
+	}
+	for i, proc := range procs {
+		select {
+		case <-proc.stopped:
+		default:
+			t.Error("Context not cancelled for process", i)
+		}
+	}
+	if hookRun {
+		t.Error("Cleanup hook run although a process did not stop")
+	}
+}
+
+func TestWaitForShutdownGraceful(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- os.Interrupt
+	}()
+
+	if code := WaitForShutdown(context.Background(), sig, proc); code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+}
+
+func TestWaitForShutdownForced(t *testing.T) {
+	proc := newFakeProcess()
+	defer close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- os.Interrupt
+		// The process must be stopped on the first signal
+		<-proc.stopped
+		sig <- os.Interrupt
+	}()
+
+	if code := WaitForShutdown(context.Background(), sig, proc); code != exitForced {
+		t.Error("Expected forced exit code, got", code)
+	}
+}
+
+func TestWaitForShutdownSIGTERM(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- syscall.SIGTERM
+	}()
+
+	if code := WaitForShutdown(context.Background(), sig, proc); code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+	select {
+	case <-proc.stopped:
+	default:
+		t.Error("Process not stopped on SIGTERM")
+	}
+}
+
+func TestShutdownOSSignal(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// Shutdown listens for signals before it runs the process
+		<-proc.running
+		err := self.Signal(syscall.SIGTERM)
+		if err != nil {
+			cancel()
+		}
+		errCh <- err
+	}()
+
+	code := Shutdown(ctx, proc, syscall.SIGINT, syscall.SIGTERM)
+	if err := <-errCh; err != nil {
+		t.Skip("Cannot send SIGTERM on this platform:", err)
+	}
+	if code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+}
+
+func TestWaitForShutdownReturnsWhenDone(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- os.Interrupt
+	}()
+
+	// Returns without a second signal as soon as the process is done
+	start := time.Now()
+	if code := WaitForShutdown(context.Background(), sig, proc); code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Shutdown took too long although the process was done", elapsed)
+	}
+}
+
+func TestRunGraceful(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-proc.running
+		cancel()
+	}()
+
+	cleanedUp, lastResort := false, false
+	if code := run(ctx, proc, func() { cleanedUp = true }, func() { lastResort = true }); code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+	if !cleanedUp {
+		t.Error("Cleanup not run after graceful shutdown")
+	}
+	if lastResort {
+		t.Error("Last resort run after graceful shutdown")
+	}
+}
+
+func TestRunForced(t *testing.T) {
+	// The process never finishes stopping
+	proc := newFakeProcess()
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		<-proc.running
+		err := self.Signal(syscall.SIGINT)
+		if err == nil {
+			<-proc.stopped
+			err = self.Signal(syscall.SIGINT)
+		}
+		if err != nil {
+			cancel()
+		}
+		errCh <- err
+	}()
+
+	cleanedUp := false
+	lastResort := make(chan struct{})
+	code := run(ctx, proc, func() { cleanedUp = true }, func() { close(lastResort) })
+	if err := <-errCh; err != nil {
+		t.Skip("Cannot send SIGINT on this platform:", err)
+	}
+	if code != exitForced {
+		t.Error("Expected forced exit code, got", code)
+	}
+	if cleanedUp {
+		t.Error("Cleanup run after forced shutdown")
+	}
+	select {
+	case <-lastResort:
+	default:
+		t.Error("Last resort not run before the forced exit")
+	}
+}
+
+func TestMockProcessRunCancelled(t *testing.T) {
+	proc := MockProcess{}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	returned := make(chan struct{})
+	go func() {
+		proc.Run(ctx)
+		close(returned)
+	}()
+
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Run did not return after cancelling its context")
+	}
+	select {
+	case <-proc.Done():
+	default:
+		t.Error("Done not closed after Run returned")
+	}
+}
+
+// flakyProcess returns from Run right away, or panics if panics is set
+type flakyProcess struct {
+	runs   int
+	panics bool
+}
+
+func (p *flakyProcess) Run(ctx context.Context) {
+	p.runs++
+	if p.panics {
+		panic("flaky process")
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	for _, panics := range []bool{false, true} {
+		proc := &flakyProcess{panics: panics}
+		s := Supervise(proc, 3, time.Millisecond)
+
+		s.Run(context.Background())
+		if restarts := s.Restarts(); restarts != 3 {
+			t.Error("Expected 3 restarts, got", restarts)
+		}
+		if proc.runs != 4 {
+			t.Error("Expected process to run 4 times, ran", proc.runs)
+		}
+	}
+}
+
+func TestSuperviseCancelled(t *testing.T) {
+	proc := &flakyProcess{}
+	s := Supervise(proc, 3, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	// Returns while waiting for the first restart
+	start := time.Now()
+	s.Run(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Run did not return after cancelling its context", elapsed)
+	}
+	if restarts := s.Restarts(); restarts != 0 {
+		t.Error("Expected no restarts after cancelling, got", restarts)
+	}
+}
+
+func TestSupervisedShutdown(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- os.Interrupt
+	}()
+
+	s := Supervise(proc, 3, time.Millisecond)
+	if code := WaitForShutdown(context.Background(), sig, s); code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+	if restarts := s.Restarts(); restarts != 0 {
+		t.Error("Expected no restarts on shutdown, got", restarts)
+	}
+}
+
+func TestNewMockProcess(t *testing.T) {
+	for _, tc := range []struct {
+		stopDelay time.Duration
+		graceful  bool
+	}{
+		{10 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+	} {
+		working := make(chan struct{})
+		returned := make(chan struct{})
+		proc := NewMockProcess(func(ctx context.Context) {
+			close(working)
+			<-ctx.Done()
+		}, tc.stopDelay)
+
+		go func() {
+			proc.Run(context.Background())
+			close(returned)
+		}()
+		<-working
+
+		sig := make(chan os.Signal, 1)
+		sig <- os.Interrupt
+		if graceful := GracefulShutdown(proc, 100*time.Millisecond, sig); graceful != tc.graceful {
+			t.Errorf("Expected graceful %v with stop delay %v, got %v", tc.graceful, tc.stopDelay, graceful)
+		}
+
+		// The work stops eventually in both cases
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Error("Run did not return after Stop with stop delay", tc.stopDelay)
+		}
+	}
+}
+
+func TestNewMockProcessCancelled(t *testing.T) {
+	proc := NewMockProcess(func(ctx context.Context) { <-ctx.Done() }, 50*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	returned := make(chan struct{})
+	go func() {
+		proc.Run(ctx)
+		close(returned)
+	}()
+
+	start := time.Now()
+	cancel()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancelling its context")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Error("Run returned before the stop delay passed", elapsed)
+	}
+	select {
+	case <-proc.Done():
+	default:
+		t.Error("Done not closed after Run returned")
+	}
+}
+
+func TestNewMockProcessStopTwice(t *testing.T) {
+	proc := NewMockProcess(func(ctx context.Context) { <-ctx.Done() }, time.Millisecond)
+
+	returned := make(chan struct{})
+	go func() {
+		proc.Run(context.Background())
+		close(returned)
+	}()
+
+	proc.Stop()
+	proc.Stop()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestWaitForShutdownCleanupHooks(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- os.Interrupt
+	}()
+
+	var order []int
+	hook := func(i int) CleanupHook {
+		return func(ctx context.Context) error {
+			select {
+			case <-proc.done:
+			default:
+				t.Error("Cleanup hook ran before the process stopped")
+			}
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("Expected cleanup hook context to have a deadline")
+			}
+			order = append(order, i)
+			return nil
+		}
+	}
+
+	code := WaitForShutdown(context.Background(), sig, proc, hook(1), hook(2), hook(3))
+	if code != exitGraceful {
+		t.Error("Expected graceful exit code, got", code)
+	}
+	if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+		t.Error("Expected cleanup hooks to run in order, got", order)
+	}
+}
+
+func TestWaitForShutdownCleanupHookError(t *testing.T) {
+	proc := newFakeProcess()
+	close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- os.Interrupt
+	}()
+
+	ranLast := false
+	code := WaitForShutdown(context.Background(), sig, proc,
+		func(ctx context.Context) error { return errors.New("pool busy") },
+		func(ctx context.Context) error { ranLast = true; return nil },
+	)
+	if code != exitForced {
+		t.Error("Expected forced exit code after a failing hook, got", code)
+	}
+	if ranLast {
+		t.Error("Expected hooks after a failing hook to be skipped")
+	}
+}
+
+func TestRunCleanupDeadline(t *testing.T) {
+	sig := make(chan os.Signal, 1)
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	start := time.Now()
+	code := runCleanup(start.Add(100*time.Millisecond), sig, &signalCounter{policy: DefaultSignalPolicy}, []CleanupHook{
+		func(ctx context.Context) error {
+			// Ignores its context
+			<-blocked
+			return nil
+		},
+	})
+	if code != exitForced {
+		t.Error("Expected forced exit code after the deadline, got", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Cleanup did not return at the deadline", elapsed)
+	}
+}
+
+func TestWaitForShutdownPolicyImmediateForce(t *testing.T) {
+	proc := newFakeProcess()
+	defer close(proc.release)
+
+	sig := make(chan os.Signal, 1)
+	go func() {
+		<-proc.running
+		sig <- syscall.SIGQUIT
+	}()
+
+	policy := SignalPolicy{
+		Actions:    map[os.Signal]SignalAction{syscall.SIGQUIT: ActionForce},
+		ForceAfter: 3,
+	}
+	start := time.Now()
+	if code := WaitForShutdownWithPolicy(context.Background(), sig, []Process{proc}, policy); code != exitForced {
+		t.Error("Expected forced exit code on SIGQUIT, got", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected SIGQUIT to force the shutdown right away", elapsed)
+	}
+}
+
+func TestWaitForShutdownPolicyEscalation(t *testing.T) {
+	proc := newFakeProcess()
+	defer close(proc.release)
+
+	sig := make(chan os.Signal)
+	policy := SignalPolicy{ForceAfter: 3}
+
+	code := make(chan int, 1)
+	go func() {
+		code <- WaitForShutdownWithPolicy(context.Background(), sig, []Process{proc}, policy)
+	}()
+
+	<-proc.running
+	sig <- os.Interrupt
+	<-proc.stopped
+	sig <- os.Interrupt
+	select {
+	case c := <-code:
+		t.Fatal("Expected two SIGINTs not to force the shutdown, got", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sig <- os.Interrupt
+	if c := <-code; c != exitForced {
+		t.Error("Expected forced exit code on the third SIGINT, got", c)
+	}
+}
+
+func TestRunLastResortTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	start := time.Now()
+	runLastResort(func() { <-hang }, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected a hanging last resort not to block the exit", elapsed)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CleanupHook releases a resource during a graceful shutdown, e.g.
+// flushes logs or closes a database pool. It should return once ctx is
+// done.
+type CleanupHook func(ctx context.Context) error
+
+// runCleanup runs hooks one after another until deadline and returns
+// the exit code for the program. It stops at the first hook which
+// returns an error and returns exitForced then, as well as when a
+// signal on sig forces the shutdown according to counter or deadline
+// passes.
+func runCleanup(deadline time.Time, sig <-chan os.Signal, counter *signalCounter, hooks []CleanupHook) int {
+	if len(hooks) == 0 {
+		return exitGraceful
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	// Buffered so that a hook finishing late does not leak
+	result := make(chan error, 1)
+	go func() {
+		for i, hook := range hooks {
+			if err := hook(ctx); err != nil {
+				result <- fmt.Errorf("cleanup hook %d: %w", i, err)
+				return
+			}
+		}
+		result <- nil
+	}()
+
+	for {
+		select {
+		case err := <-result:
+			if err != nil {
+				fmt.Println("\n" + err.Error())
+				return exitForced
+			}
+			return exitGraceful
+		case s := <-sig:
+			if counter.force(s) {
+				return exitForced
+			}
+		case <-ctx.Done():
+			return exitForced
+		}
+	}
+}
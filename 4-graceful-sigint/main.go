@@ -13,10 +13,245 @@
 
 package main
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// shutdownTimeout is how long the process gets to stop gracefully
+	// before the program is killed anyway
+	shutdownTimeout = 10 * time.Second
+	// lastResortTimeout is how long the last resort action may take
+	// before the program is killed anyway
+	lastResortTimeout = time.Second
+
+	// exitGraceful is the exit code after the process stopped
+	exitGraceful = 0
+	// exitForced is the exit code when the process had to be killed
+	exitForced = 1
+	// exitTimeout is the exit code when processes did not stop within
+	// the shutdown timeout
+	exitTimeout = 2
+
+	// maxRestarts is how often the process is restarted if it ends
+	// unexpectedly
+	maxRestarts = 3
+	// restartBackoff is the wait before the first restart
+	restartBackoff = time.Second
+)
+
+// Stopper is a process which can be stopped gracefully. Stop may
+// block, Done is closed once the process actually stopped.
+type Stopper interface {
+	Stop()
+	Done() <-chan struct{}
+}
+
+// Process runs until its context is cancelled
+type Process interface {
+	Run(ctx context.Context)
+}
+
+// SignalAction is what a signal triggers during a shutdown
+type SignalAction int
+
+const (
+	// ActionGraceful starts a graceful shutdown, repeated signals kill
+	// the program once the SignalPolicy's ForceAfter is reached
+	ActionGraceful SignalAction = iota
+	// ActionForce kills the program right away
+	ActionForce
+)
+
+// SignalPolicy decides when signals kill the program instead of
+// waiting for the graceful shutdown
+type SignalPolicy struct {
+	// Actions maps signals to their action, signals missing from the
+	// map are graceful
+	Actions map[os.Signal]SignalAction
+	// ForceAfter is the number of signals after which the program is
+	// killed, zero means DefaultSignalPolicy's
+	ForceAfter int
+}
+
+// DefaultSignalPolicy stops gracefully on the first signal and kills
+// the program on the second one
+var DefaultSignalPolicy = SignalPolicy{ForceAfter: 2}
+
+// signalCounter applies a SignalPolicy to the signals received so far
+type signalCounter struct {
+	policy   SignalPolicy
+	received int
+}
+
+// force counts s and reports whether the program must be killed now
+func (c *signalCounter) force(s os.Signal) bool {
+	c.received++
+
+	forceAfter := c.policy.ForceAfter
+	if forceAfter <= 0 {
+		forceAfter = DefaultSignalPolicy.ForceAfter
+	}
+	return c.policy.Actions[s] == ActionForce || c.received >= forceAfter
+}
+
+// GracefulShutdown waits for the first signal on sig and tries to stop
+// proc gracefully. It returns true once proc is done and false if
+// another signal arrives or the process did not stop within timeout,
+// in which case the caller should kill the program.
+func GracefulShutdown(proc Stopper, timeout time.Duration, sig <-chan os.Signal) bool {
+	counter := &signalCounter{policy: DefaultSignalPolicy}
+	counter.force(<-sig)
+
+	go proc.Stop()
+	return waitStopped(proc.Done(), timeout, sig, counter) == exitGraceful
+}
+
+// WaitForShutdown runs proc in the background until a signal arrives
+// on sig or ctx is done. It then stops proc gracefully by cancelling
+// the context passed to Run, runs hooks in the given order and returns
+// the exit code for the program, exitGraceful if Run returned and all
+// hooks succeeded. It returns exitTimeout if Run did not return within
+// shutdownTimeout and exitForced if another signal arrived, a hook
+// failed or cleaning up took longer than the rest of shutdownTimeout.
+func WaitForShutdown(ctx context.Context, sig <-chan os.Signal, proc Process, hooks ...CleanupHook) int {
+	return WaitForShutdownWithPolicy(ctx, sig, []Process{proc}, DefaultSignalPolicy, hooks...)
+}
+
+// WaitForShutdownWithPolicy is like WaitForShutdown but runs all procs
+// with a shared context, which is cancelled for all of them at once,
+// and waits for all of them before running hooks. policy decides which
+// signals kill the program, e.g. SIGQUIT right away and SIGINT only on
+// the third one.
+func WaitForShutdownWithPolicy(ctx context.Context, sig <-chan os.Signal, procs []Process, policy SignalPolicy, hooks ...CleanupHook) int {
+	return waitForShutdown(ctx, sig, procs, policy, shutdownTimeout, hooks)
+}
+
+// waitForShutdown is WaitForShutdownWithPolicy taking the shutdown
+// timeout
+func waitForShutdown(ctx context.Context, sig <-chan os.Signal, procs []Process, policy SignalPolicy, timeout time.Duration, hooks []CleanupHook) int {
+	counter := &signalCounter{policy: policy}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, proc := range procs {
+		wg.Add(1)
+		go func(proc Process) {
+			defer wg.Done()
+			proc.Run(runCtx)
+		}(proc)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case s := <-sig:
+		if counter.force(s) {
+			return exitForced
+		}
+	case <-runCtx.Done():
+	case <-stopped:
+		// All processes ended on their own
+		return runCleanup(time.Now().Add(timeout), sig, counter, hooks)
+	}
+
+	deadline := time.Now().Add(timeout)
+	cancel()
+	if code := waitStopped(stopped, timeout, sig, counter); code != exitGraceful {
+		return code
+	}
+	return runCleanup(deadline, sig, counter, hooks)
+}
+
+// Shutdown is WaitForShutdown for the given OS signals, e.g.
+// syscall.SIGINT and the syscall.SIGTERM sent by container
+// orchestrators. Every signal in the set is treated the same way.
+func Shutdown(ctx context.Context, proc Process, signals ...os.Signal) int {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, signals...)
+	defer signal.Stop(sig)
+
+	return WaitForShutdown(ctx, sig, proc)
+}
+
+// waitStopped waits for stopped to be closed and returns exitGraceful
+// then. It returns exitForced if a signal on sig forces the shutdown
+// according to counter and exitTimeout if timeout passes before.
+func waitStopped(stopped <-chan struct{}, timeout time.Duration, sig <-chan os.Signal, counter *signalCounter) int {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stopped:
+			return exitGraceful
+		case s := <-sig:
+			if counter.force(s) {
+				return exitForced
+			}
+		case <-timer.C:
+			return exitTimeout
+		}
+	}
+}
+
+// run runs proc until SIGINT or SIGTERM and returns the exit code for
+// the program. cleanup only runs after a graceful shutdown. A forced
+// shutdown only runs lastResort, e.g. to dump state or send a final
+// metric, if it is not nil and returns after lastResortTimeout at the
+// latest, so that the program gets killed without waiting for proc.
+func run(ctx context.Context, proc Process, cleanup, lastResort func()) int {
+	code := Shutdown(ctx, proc, syscall.SIGINT, syscall.SIGTERM)
+	if code != exitGraceful {
+		fmt.Println("\nKilling process")
+		runLastResort(lastResort, lastResortTimeout)
+		return code
+	}
+	cleanup()
+	return code
+}
+
+// runLastResort runs lastResort and waits for it at most timeout, a
+// hanging lastResort keeps running until the program exits
+func runLastResort(lastResort func(), timeout time.Duration) {
+	if lastResort == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		lastResort()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		fmt.Println("\nLast resort timed out")
+	}
+}
+
 func main() {
 	// Create a process
 	proc := MockProcess{}
 
-	// Run the process (blocking)
-	proc.Run()
+	// os.Exit skips deferred calls, so it is only called here at the
+	// very top once run returned
+	os.Exit(run(context.Background(), Supervise(&proc, maxRestarts, restartBackoff), func() {
+		fmt.Println("\nProcess stopped gracefully")
+	}, nil))
 }
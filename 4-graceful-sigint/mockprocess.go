@@ -7,30 +7,117 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
 // MockProcess for example
 type MockProcess struct {
 	isRunning bool
+
+	// work and stopDelay are set by NewMockProcess, the zero value
+	// simulates a process which never stops on Stop
+	work      func(ctx context.Context)
+	stopDelay time.Duration
+	stopOnce  sync.Once
+	stopping  chan struct{}
+
+	doneOnce   sync.Once
+	done       chan struct{}
+	finishOnce sync.Once
+}
+
+// NewMockProcess creates a process which runs work until it gets
+// stopped, either by Stop or by cancelling the context passed to Run.
+// work must return once its context is done. Stopping takes stopDelay
+// in both cases, so slow shutdowns can be simulated.
+func NewMockProcess(work func(ctx context.Context), stopDelay time.Duration) *MockProcess {
+	return &MockProcess{
+		work:      work,
+		stopDelay: stopDelay,
+		stopping:  make(chan struct{}),
+	}
 }
 
-// Run will start the process
-func (m *MockProcess) Run() {
+// Run will start the process, it returns once ctx is cancelled
+func (m *MockProcess) Run(ctx context.Context) {
+	if m.work != nil {
+		m.runWork(ctx)
+		return
+	}
+
 	m.isRunning = true
+	m.Done()
 
 	fmt.Print("Process running..")
 	for {
 		fmt.Print(".")
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			fmt.Print("\nProcess stopped")
+			m.finish()
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// runWork runs the configured work until the process gets stopped
+func (m *MockProcess) runWork(ctx context.Context) {
+	m.Done()
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stopping:
+			cancel()
+		case <-workCtx.Done():
+		}
+	}()
+
+	m.work(workCtx)
+
+	// Stop takes the delay itself, a cancelled context takes it here
+	if ctx.Err() != nil {
+		time.Sleep(m.stopDelay)
+		m.finish()
 	}
 }
 
+// Done returns a channel which is closed once the process stopped,
+// Stop of the zero value in this mock example will never get there
+func (m *MockProcess) Done() <-chan struct{} {
+	m.doneOnce.Do(func() {
+		m.done = make(chan struct{})
+	})
+	return m.done
+}
+
+// finish closes the Done channel
+func (m *MockProcess) finish() {
+	m.Done()
+	m.finishOnce.Do(func() {
+		close(m.done)
+	})
+}
+
 // Stop tries to gracefully stop the process, in this mock example
-// this will not succeed
+// this will not succeed unless it was created by NewMockProcess. A
+// process created so may be stopped more than once.
 func (m *MockProcess) Stop() {
+	if m.work != nil {
+		time.Sleep(m.stopDelay)
+		m.stopOnce.Do(func() {
+			close(m.stopping)
+		})
+		m.finish()
+		return
+	}
+
 	if !m.isRunning {
 		log.Fatal("Cannot stop a process which is not running")
 	}
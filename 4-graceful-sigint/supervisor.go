@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Supervisor is a Process which restarts the process it supervises
+// whenever its Run returns or panics before the context is cancelled
+type Supervisor struct {
+	proc        Process
+	maxRestarts int
+	backoff     time.Duration
+
+	restarts atomic.Int64
+}
+
+// Supervise returns a Supervisor restarting proc up to maxRestarts
+// times. It waits backoff before the first restart and doubles the wait
+// before every further one.
+func Supervise(proc Process, maxRestarts int, backoff time.Duration) *Supervisor {
+	return &Supervisor{
+		proc:        proc,
+		maxRestarts: maxRestarts,
+		backoff:     backoff,
+	}
+}
+
+// Run runs the supervised process until ctx is cancelled or the
+// process returned again after all restarts were used up
+func (s *Supervisor) Run(ctx context.Context) {
+	backoff := s.backoff
+	for {
+		s.runOnce(ctx)
+		if ctx.Err() != nil || s.Restarts() >= s.maxRestarts {
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+		s.restarts.Add(1)
+	}
+}
+
+// Restarts returns how often the process got restarted so far
+func (s *Supervisor) Restarts() int {
+	return int(s.restarts.Load())
+}
+
+// runOnce runs the process and recovers if it panics
+func (s *Supervisor) runOnce(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("\nProcess panicked:", r)
+		}
+	}()
+	s.proc.Run(ctx)
+}
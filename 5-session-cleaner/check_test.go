@@ -1,6 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -78,3 +87,2992 @@ func TestSessionManagersCleanerAfterUpdate(t *testing.T) {
 		t.Error("Session still in memory 7 seconds after update")
 	}
 }
+
+func TestSessionManagersClose(t *testing.T) {
+	m := NewSessionManager()
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Error("Error CreateSession:", err)
+	}
+
+	m.Close()
+	m.Close() // must not panic
+
+	select {
+	case <-m.workerDone:
+	default:
+		t.Error("Worker still running after Close")
+	}
+
+	_, err = m.CreateSession()
+	if err != ErrManagerClosed {
+		t.Error("Expected ErrManagerClosed from CreateSession, got", err)
+	}
+
+	err = m.UpdateSessionData(sID, make(map[string]interface{}))
+	if err != ErrManagerClosed {
+		t.Error("Expected ErrManagerClosed from UpdateSessionData, got", err)
+	}
+}
+
+func TestSessionManagersExpirationAcrossMinutes(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	// Spread the sessions over more than a minute so that the same
+	// second of different minutes gets used
+	const sessionsCount = 70
+	base := time.Now()
+	createdAt := make(map[string]time.Time)
+	for i := 0; i < sessionsCount; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+
+		created := base.Add(time.Duration(i) * time.Second)
+		m.mu.Lock()
+		m.setSessionExpiration(sID, created.Add(defaultTTL))
+		m.mu.Unlock()
+		createdAt[sID] = created
+	}
+
+	end := base.Add((sessionsCount + 10) * time.Second)
+	for now := base; now.Before(end); now = now.Add(m.expirationCheckInterval) {
+		m.removeExpiredSessions(now)
+
+		for sID, created := range createdAt {
+			_, err := m.GetSessionData(sID)
+			age := now.Sub(created)
+			if age < defaultTTL && err == ErrSessionNotFound {
+				t.Fatalf("Session removed after %v, before its expiry", age)
+			}
+			if age >= defaultTTL+2*m.expirationCheckInterval && err != ErrSessionNotFound {
+				t.Fatalf("Session still in memory %v after creation", age)
+			}
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.sessions) != 0 {
+		t.Error("Sessions leaked:", len(m.sessions))
+	}
+}
+
+func TestSessionManagersExpiryOrder(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	// Arm the sessions out of order, then renew a few of them to later
+	// and delete others, so that entries move around in the heap
+	const sessionsCount = 50
+	base := clock.Now()
+	expireAt := make(map[string]time.Time)
+	for i := 0; i < sessionsCount; i++ {
+		ttl := time.Duration(i*37%sessionsCount+1) * time.Second
+		sID, err := m.CreateSessionWithTTL(ttl)
+		if err != nil {
+			t.Fatal("Error CreateSessionWithTTL:", err)
+		}
+		expireAt[sID] = base.Add(ttl)
+	}
+	i := 0
+	for sID := range expireAt {
+		switch i % 5 {
+		case 0:
+			if err := m.ExtendSession(sID, time.Duration(i)*time.Second); err != nil {
+				t.Fatal("Error ExtendSession:", err)
+			}
+			expireAt[sID] = expireAt[sID].Add(time.Duration(i) * time.Second)
+		case 1:
+			if err := m.DeleteSession(sID); err != nil {
+				t.Fatal("Error DeleteSession:", err)
+			}
+			delete(expireAt, sID)
+		}
+		i++
+	}
+	checkExpiryHeap(t, m)
+
+	for now := base; len(expireAt) > 0; now = now.Add(500 * time.Millisecond) {
+		m.removeExpiredSessions(now)
+		checkExpiryHeap(t, m)
+
+		for sID, at := range expireAt {
+			_, err := m.GetSessionData(sID)
+			if at.Before(now) {
+				if err != ErrSessionNotFound {
+					t.Fatalf("Session still in memory %v after its expiry", now.Sub(at))
+				}
+				delete(expireAt, sID)
+			} else if err != nil {
+				t.Fatalf("Session removed %v before its expiry", at.Sub(now))
+			}
+		}
+	}
+
+	if n := m.ActiveSessionCount(); n != 0 {
+		t.Error("Sessions leaked:", n)
+	}
+}
+
+// checkExpiryHeap fails if the expiry heap is not ordered or its index
+// does not match the entries
+func checkExpiryHeap(t *testing.T, m *SessionManager) {
+	t.Helper()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h := m.expiries
+	if len(h.index) != len(h.entries) || len(h.entries) != len(m.sessions) {
+		t.Fatalf("Expected %d expiry entries, got %d with %d indexed", len(m.sessions), len(h.entries), len(h.index))
+	}
+	for i, entry := range h.entries {
+		if h.index[entry.sessionID] != i {
+			t.Fatalf("Expiry index of %s is %d, entry is at %d", entry.sessionID, h.index[entry.sessionID], i)
+		}
+		if i > 0 && h.Less(i, (i-1)/2) {
+			t.Fatalf("Expiry entry %d is due before its parent", i)
+		}
+	}
+}
+
+func TestSessionManagersConcurrentReadAndUpdate(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			data, err := m.GetSessionData(sID)
+			if err != nil {
+				t.Error("Error GetSessionData:", err)
+				return
+			}
+			// Mutating the returned copy must not race with the manager
+			data["reader"] = i
+			_ = data["counter"]
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			data := map[string]interface{}{"counter": strconv.Itoa(i)}
+			if err := m.UpdateSessionData(sID, data); err != nil {
+				t.Error("Error UpdateSessionData:", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	data, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if _, ok := data["reader"]; ok {
+		t.Error("Modifying a returned copy changed the stored session")
+	}
+}
+
+func TestSessionManagersSubSecondTTL(t *testing.T) {
+	m := NewSessionManagerWithTTL(200 * time.Millisecond)
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = m.GetSessionData(sID)
+	if err == ErrSessionNotFound {
+		t.Error("Session removed before its ttl of 200ms")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	_, err = m.GetSessionData(sID)
+	if err != ErrSessionNotFound {
+		t.Error("Session still in memory 500ms after creation")
+	}
+}
+
+func TestSessionManagersDeleteSession(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	err = m.DeleteSession(sID)
+	if err != nil {
+		t.Error("Error DeleteSession:", err)
+	}
+
+	_, err = m.GetSessionData(sID)
+	if err != ErrSessionNotFound {
+		t.Error("Session still in memory after DeleteSession")
+	}
+
+	err = m.DeleteSession(sID)
+	if err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound deleting twice, got", err)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.expiries.index[sID]; ok {
+		t.Error("Deleted session left behind in expiry index")
+	}
+	for _, entry := range m.expiries.entries {
+		if entry.sessionID == sID {
+			t.Error("Deleted session left behind in expiry heap")
+		}
+	}
+}
+
+func TestSessionManagersActiveSessionCount(t *testing.T) {
+	m := NewSessionManagerWithTTL(200 * time.Millisecond)
+	defer m.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := m.CreateSession(); err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+	}
+
+	if count := m.ActiveSessionCount(); count != 3 {
+		t.Error("Expected 3 active sessions, got", count)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if count := m.ActiveSessionCount(); count != 0 {
+		t.Error("Expected 0 active sessions after expiry, got", count)
+	}
+}
+
+func TestSessionManagersPerSessionTTL(t *testing.T) {
+	m := NewSessionManagerWithTTL(200 * time.Millisecond)
+	defer m.Close()
+
+	shortID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	longID, err := m.CreateSessionWithTTL(time.Second)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if _, err = m.GetSessionData(shortID); err != ErrSessionNotFound {
+		t.Error("Session with manager ttl still in memory after 500ms")
+	}
+
+	// Renewing must keep using the session's own ttl
+	err = m.UpdateSessionData(longID, make(map[string]interface{}))
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	if _, err = m.GetSessionData(longID); err == ErrSessionNotFound {
+		t.Error("Session with 1s ttl removed 700ms after update")
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	if _, err = m.GetSessionData(longID); err != ErrSessionNotFound {
+		t.Error("Session with 1s ttl still in memory 1.4s after update")
+	}
+}
+
+func TestSessionManagersOnExpire(t *testing.T) {
+	m := NewSessionManagerWithTTL(200 * time.Millisecond)
+	defer m.Close()
+
+	type expiredSession struct {
+		id   string
+		data map[string]interface{}
+	}
+	expiredCh := make(chan expiredSession, 1)
+	m.OnExpire(func(sessionID string, data map[string]interface{}) {
+		// Calling back into the manager must not deadlock
+		m.ActiveSessionCount()
+		expiredCh <- expiredSession{sessionID, data}
+	})
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	err = m.UpdateSessionData(sID, map[string]interface{}{"website": "longhoang.de"})
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	select {
+	case expired := <-expiredCh:
+		if expired.id != sID {
+			t.Error("OnExpire called with wrong sessionID", expired.id)
+		}
+		if expired.data["website"] != "longhoang.de" {
+			t.Error("OnExpire called with wrong data", expired.data)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnExpire not called within 1s")
+	}
+}
+
+func TestSessionManagersCloseFromOnExpire(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+
+	closed := make(chan struct{})
+	m.OnExpire(func(sessionID string, data map[string]interface{}) {
+		// Close waits for the worker running this callback, so it must
+		// not be called directly
+		go func() {
+			m.Close()
+			close(closed)
+		}()
+	})
+
+	if _, err := m.CreateSession(); err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.mu.Lock()
+	clock.now = clock.now.Add(2 * defaultTTL)
+	clock.mu.Unlock()
+	if n := m.Prune(); n != 1 {
+		t.Error("Expected the session to expire, got", n)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close from an OnExpire callback did not return")
+	}
+	if _, err := m.CreateSession(); err != ErrManagerClosed {
+		t.Error("Expected ErrManagerClosed after Close, got", err)
+	}
+}
+
+func TestSessionManagersCancelledContext(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = m.GetSessionDataContext(ctx, sID)
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled from GetSessionDataContext, got", err)
+	}
+
+	data := map[string]interface{}{"website": "longhoang.de"}
+	err = m.UpdateSessionDataContext(ctx, sID, data)
+	if err != context.Canceled {
+		t.Error("Expected context.Canceled from UpdateSessionDataContext, got", err)
+	}
+
+	data, err = m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if _, ok := data["website"]; ok {
+		t.Error("Session updated despite cancelled context")
+	}
+}
+
+// fakeClock is a Clock which only moves forward on Advance
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	period  time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+// Advance moves the clock forward by d, firing every tick on the way.
+// Each tick is delivered twice on the unbuffered channel: the second
+// send only succeeds once the worker handled the first one, so the
+// sweep is complete when Advance returns.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+		var due *fakeTicker
+		for _, t := range c.tickers {
+			if !t.stopped && !t.next.After(end) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = due.next
+		due.next = due.next.Add(due.period)
+		now := c.now
+		c.mu.Unlock()
+
+		due.c <- now
+		due.c <- now
+	}
+}
+
+func TestSessionManagersFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	clock.Advance(3 * time.Second)
+	err = m.UpdateSessionData(sID, make(map[string]interface{}))
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	clock.Advance(defaultTTL)
+	if _, err = m.GetSessionData(sID); err == ErrSessionNotFound {
+		t.Error("Session removed 5 seconds after update")
+	}
+
+	clock.Advance(2 * time.Second)
+	if _, err = m.GetSessionData(sID); err != ErrSessionNotFound {
+		t.Error("Session still in memory 7 seconds after update")
+	}
+}
+
+func TestSessionManagersTouch(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	err = m.UpdateSessionData(sID, map[string]interface{}{"website": "longhoang.de"})
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		clock.Advance(2 * time.Second)
+		if err := m.Touch(sID); err != nil {
+			t.Fatal("Error Touch:", err)
+		}
+	}
+
+	data, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Session not found although touched every 2 seconds")
+	}
+	if data["website"] != "longhoang.de" {
+		t.Error("Touch changed the session data")
+	}
+
+	if err = m.Touch("unknown"); err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound touching unknown session, got", err)
+	}
+}
+
+func TestSessionManagersUpdateSessionField(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	const keysCount = 100
+	var wg sync.WaitGroup
+	for i := 0; i < keysCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := m.UpdateSessionField(sID, "key"+strconv.Itoa(i), i)
+			if err != nil {
+				t.Error("Error UpdateSessionField:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	data, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	for i := 0; i < keysCount; i++ {
+		if data["key"+strconv.Itoa(i)] != i {
+			t.Error("Lost concurrent update of key", i)
+		}
+	}
+
+	err = m.UpdateSessionField("unknown", "key", 1)
+	if err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound for unknown session, got", err)
+	}
+}
+
+func TestSessionManagersMaxSessions(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithMaxSessions(100))
+	defer m.Close()
+
+	var sIDs []string
+	for i := 0; i < 150; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sIDs = append(sIDs, sID)
+		clock.Advance(10 * time.Millisecond)
+	}
+
+	if count := m.ActiveSessionCount(); count != 100 {
+		t.Error("Expected 100 sessions to remain, got", count)
+	}
+	for i, sID := range sIDs {
+		_, err := m.GetSessionData(sID)
+		if i < 50 && err != ErrSessionNotFound {
+			t.Error("Expected oldest session to be evicted:", i)
+		}
+		if i >= 50 && err != nil {
+			t.Error("Expected newest session to remain:", i)
+		}
+	}
+}
+
+func TestSessionManagersMaxSessionsLeastRecentlyUpdated(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithMaxSessions(3))
+	defer m.Close()
+
+	// The stale session expires last, the others are updated after it
+	// but expire first
+	stale, err := m.CreateSessionWithTTL(time.Hour)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	updated, err := m.CreateSessionWithTTL(time.Second)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	touched, err := m.CreateSessionWithTTL(time.Second)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	if err := m.ExtendSession(stale, time.Hour); err != nil {
+		t.Fatal("Error ExtendSession:", err)
+	}
+	if err := m.UpdateSessionData(updated, map[string]interface{}{"visits": 1}); err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+	if err := m.Touch(touched); err != nil {
+		t.Fatal("Error Touch:", err)
+	}
+
+	if _, err := m.CreateSession(); err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	if m.SessionExists(stale) {
+		t.Error("Expected the least recently updated session to be evicted")
+	}
+	if !m.SessionExists(updated) || !m.SessionExists(touched) {
+		t.Error("Expected recently updated sessions to be kept although they expire first")
+	}
+}
+
+func TestSessionManagersSessionExists(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	if !m.SessionExists(sID) {
+		t.Error("Expected created session to exist")
+	}
+	if m.SessionExists("unknown") {
+		t.Error("Expected unknown session not to exist")
+	}
+}
+
+func TestSessionManagersSessionIDGenerator(t *testing.T) {
+	m := NewSessionManager(WithSessionIDGenerator(func() (string, error) {
+		return "duplicate", nil
+	}))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	if sID != "duplicate" {
+		t.Error("Expected injected sessionID, got", sID)
+	}
+	err = m.UpdateSessionData(sID, map[string]interface{}{"website": "longhoang.de"})
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	_, err = m.CreateSession()
+	if err != ErrSessionIDCollision {
+		t.Error("Expected ErrSessionIDCollision, got", err)
+	}
+
+	data, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if data["website"] != "longhoang.de" {
+		t.Error("Colliding CreateSession overwrote the existing session")
+	}
+}
+
+func TestSessionManagersSessionIDCollisionRetry(t *testing.T) {
+	var calls int
+	ids := []string{"a", "a", "a", "b"}
+	m := NewSessionManager(WithSessionIDGenerator(func() (string, error) {
+		id := ids[calls%len(ids)]
+		calls++
+		return id, nil
+	}))
+	defer m.Close()
+
+	if _, err := m.CreateSession(); err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	// "a" is taken, so the generator is called until it returns "b"
+	calls = 1
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession after retry:", err)
+	}
+	if sID != "b" || calls != 4 {
+		t.Errorf("Expected sessionID b after 3 attempts, got %v after %d", sID, calls-1)
+	}
+
+	// Both ids are taken now, every attempt collides
+	calls = 0
+	_, err = m.CreateSession()
+	if err != ErrSessionIDCollision {
+		t.Error("Expected ErrSessionIDCollision, got", err)
+	}
+	if calls != sessionIDAttempts {
+		t.Errorf("Expected %d attempts, got %d", sessionIDAttempts, calls)
+	}
+}
+
+func TestSessionManagersGetSessionsData(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	var sIDs []string
+	for i := 0; i < 3; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		err = m.UpdateSessionField(sID, "index", i)
+		if err != nil {
+			t.Fatal("Error UpdateSessionField:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+
+	result, err := m.GetSessionsData(append(sIDs, "unknown"))
+	if err != nil {
+		t.Fatal("Error GetSessionsData:", err)
+	}
+	if len(result) != len(sIDs) {
+		t.Errorf("Expected %d sessions, got %d", len(sIDs), len(result))
+	}
+	for i, sID := range sIDs {
+		if result[sID]["index"] != i {
+			t.Error("Wrong data for session", i, result[sID])
+		}
+	}
+	if _, ok := result["unknown"]; ok {
+		t.Error("Unknown sessionID included in result")
+	}
+}
+
+func TestSessionManagersGetSessionExpiry(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	created, err := m.GetSessionExpiry(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionExpiry:", err)
+	}
+	if !created.Equal(clock.Now().Add(defaultTTL)) {
+		t.Error("Expected expiry ttl after creation, got", created)
+	}
+
+	clock.Advance(2 * time.Second)
+	err = m.UpdateSessionData(sID, make(map[string]interface{}))
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	updated, err := m.GetSessionExpiry(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionExpiry:", err)
+	}
+	if updated.Sub(created) != 2*time.Second {
+		t.Error("Expected expiry to move 2s forward, moved", updated.Sub(created))
+	}
+
+	_, err = m.GetSessionExpiry("unknown")
+	if err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound for unknown session, got", err)
+	}
+}
+
+func TestSessionManagersExpirationCheckInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithExpirationCheckInterval(interval))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	var elapsed time.Duration
+	for m.SessionExists(sID) && elapsed < 2*defaultTTL {
+		clock.Advance(10 * time.Millisecond)
+		elapsed += 10 * time.Millisecond
+	}
+
+	if elapsed < defaultTTL || elapsed > defaultTTL+2*interval {
+		t.Errorf("Expected eviction within %v of the ttl, got evicted after %v", 2*interval, elapsed)
+	}
+}
+
+func TestSessionManagersSnapshot(t *testing.T) {
+	m := NewSessionManager()
+
+	sIDs := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		err = m.UpdateSessionField(sID, "index", i)
+		if err != nil {
+			t.Fatal("Error UpdateSessionField:", err)
+		}
+		sIDs[sID] = i
+	}
+
+	snapshot := m.Snapshot()
+	m.Close()
+
+	restored := NewSessionManager()
+	defer restored.Close()
+	if err := restored.LoadSnapshot(snapshot, false); err != nil {
+		t.Fatal("Error LoadSnapshot:", err)
+	}
+
+	if count := restored.ActiveSessionCount(); count != len(sIDs) {
+		t.Errorf("Expected %d restored sessions, got %d", len(sIDs), count)
+	}
+	for sID, i := range sIDs {
+		data, err := restored.GetSessionData(sID)
+		if err != nil {
+			t.Fatal("Error GetSessionData:", err)
+		}
+		if data["index"] != i {
+			t.Error("Wrong data for restored session", i, data)
+		}
+	}
+
+	// The snapshot must not alias the restored sessions
+	for _, session := range snapshot {
+		session.Data["index"] = -1
+	}
+	for sID, i := range sIDs {
+		data, _ := restored.GetSessionData(sID)
+		if data["index"] != i {
+			t.Error("Modifying the snapshot changed a restored session")
+		}
+	}
+}
+
+func TestSessionManagersUpdateDuringDelete(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	for i := 0; i < 100; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := m.DeleteSession(sID); err != nil {
+				t.Error("Error DeleteSession:", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := m.UpdateSessionData(sID, make(map[string]interface{}))
+			if err != nil && err != ErrSessionNotFound {
+				t.Error("Error UpdateSessionData:", err)
+			}
+		}()
+		wg.Wait()
+
+		if m.SessionExists(sID) {
+			t.Fatal("Deleted session resurrected by concurrent update")
+		}
+	}
+}
+
+func TestSessionManagersTyped(t *testing.T) {
+	type cart struct {
+		Items int
+		Owner string
+	}
+
+	clock := newFakeClock()
+	m := NewTypedSessionManager[cart](NewSessionManager(WithClock(clock)))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	value, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if value != (cart{}) {
+		t.Error("Expected zero value for new session, got", value)
+	}
+
+	err = m.UpdateSessionData(sID, cart{Items: 3, Owner: "gopher"})
+	if err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	value, err = m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if value.Items != 3 || value.Owner != "gopher" {
+		t.Error("Wrong value after round trip", value)
+	}
+
+	clock.Advance(defaultTTL + 2*time.Second)
+	_, err = m.GetSessionData(sID)
+	if err != ErrSessionNotFound {
+		t.Error("Typed session still in memory after ttl")
+	}
+}
+
+func TestSessionManagersForEachSession(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := m.CreateSession(); err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+	}
+
+	var count int
+	m.ForEachSession(func(sessionID string, data map[string]interface{}) bool {
+		count++
+		// Calling back into the manager must not deadlock
+		if err := m.Touch(sessionID); err != nil {
+			t.Error("Error Touch:", err)
+		}
+		data["modified"] = true
+		return true
+	})
+	if count != 5 {
+		t.Error("Expected 5 iterations, got", count)
+	}
+
+	count = 0
+	m.ForEachSession(func(sessionID string, data map[string]interface{}) bool {
+		count++
+		if _, ok := data["modified"]; ok {
+			t.Error("Modifying the passed data changed the stored session")
+		}
+		return count < 2
+	})
+	if count != 2 {
+		t.Error("Expected iteration to stop after 2 sessions, got", count)
+	}
+}
+
+func TestSessionManagersExpirations(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	clock.Advance(defaultTTL + 2*time.Second)
+	select {
+	case expired := <-m.Expirations():
+		if expired != sID {
+			t.Error("Expected expired sessionID", sID, "got", expired)
+		}
+	default:
+		t.Error("No expiration received")
+	}
+
+	m.Close()
+	if _, ok := <-m.Expirations(); ok {
+		t.Error("Expirations channel not closed after Close")
+	}
+}
+
+func TestSessionManagersCreateSessionWithData(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	data := map[string]interface{}{"website": "longhoang.de"}
+	sID, err := m.CreateSessionWithData(data)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+	data["website"] = "changed"
+
+	stored, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if stored["website"] != "longhoang.de" {
+		t.Error("Expected data right after creation, got", stored)
+	}
+}
+
+func TestSessionManagersStats(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	var sIDs []string
+	for i := 0; i < 3; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+	if err := m.DeleteSession(sIDs[0]); err != nil {
+		t.Fatal("Error DeleteSession:", err)
+	}
+
+	stats := m.Stats()
+	if stats != (Stats{CreatedTotal: 3, DeletedTotal: 1, CurrentActive: 2}) {
+		t.Error("Wrong stats before expiry", stats)
+	}
+
+	clock.Advance(defaultTTL + 2*time.Second)
+	stats = m.Stats()
+	if stats != (Stats{CreatedTotal: 3, ExpiredTotal: 2, DeletedTotal: 1}) {
+		t.Error("Wrong stats after expiry", stats)
+	}
+}
+
+func TestSessionManagersStatsBalance(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithMaxSessions(3))
+	defer m.Close()
+
+	balanced := func(when string) {
+		stats := m.Stats()
+		in := stats.CreatedTotal + stats.LoadedTotal
+		out := stats.ExpiredTotal + stats.DeletedTotal + stats.EvictedTotal
+		if in-out != stats.CurrentActive {
+			t.Errorf("Unbalanced stats %s: %+v", when, stats)
+		}
+	}
+
+	var sIDs []string
+	for i := 0; i < 5; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+	if stats := m.Stats(); stats.EvictedTotal != 2 {
+		t.Error("Expected 2 evictions, got", stats)
+	}
+	balanced("after eviction")
+
+	exported := m.ExportFor(sIDs[3:], true)
+	if err := m.ImportSessions(exported, false); err != nil {
+		t.Fatal("Error ImportSessions:", err)
+	}
+	snapshot := map[string]Session{"loaded": {Data: map[string]interface{}{}}}
+	if err := m.LoadSnapshot(snapshot, false); err != nil {
+		t.Fatal("Error LoadSnapshot:", err)
+	}
+	if stats := m.Stats(); stats.LoadedTotal != 3 {
+		t.Error("Expected 3 loaded sessions, got", stats)
+	}
+	balanced("after load")
+
+	clock.Advance(defaultTTL + 2*time.Second)
+	balanced("after expiry")
+}
+
+func TestSessionManagersNilData(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSessionWithData(nil)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+	if err = m.UpdateSessionData(sID, nil); err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	m.mu.RLock()
+	stored := m.sessions[sID].Data
+	m.mu.RUnlock()
+	if stored == nil {
+		t.Fatal("Nil data stored in session")
+	}
+
+	if err = m.UpdateSessionField(sID, "website", "longhoang.de"); err != nil {
+		t.Fatal("Error UpdateSessionField:", err)
+	}
+	data, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if len(data) != 1 || data["website"] != "longhoang.de" {
+		t.Error("Unexpected data after nil update", data)
+	}
+}
+
+func TestSessionManagersMemoryLimit(t *testing.T) {
+	// Every key is estimated at 100 bytes
+	sizeOf := func(s Session) int64 { return int64(len(s.Data)) * 100 }
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithMemoryLimit(1000, sizeOf))
+	defer m.Close()
+
+	largeData := func(keys int) map[string]interface{} {
+		data := make(map[string]interface{}, keys)
+		for i := 0; i < keys; i++ {
+			data[strconv.Itoa(i)] = i
+		}
+		return data
+	}
+
+	var sIDs []string
+	for i := 0; i < 5; i++ {
+		sID, err := m.CreateSessionWithData(largeData(4))
+		if err != nil {
+			t.Fatal("Error CreateSessionWithData:", err)
+		}
+		sIDs = append(sIDs, sID)
+		clock.Advance(10 * time.Millisecond)
+	}
+
+	// Only two sessions of 400 bytes fit into the budget
+	if count := m.ActiveSessionCount(); count != 2 {
+		t.Error("Expected 2 sessions to remain, got", count)
+	}
+	for i, sID := range sIDs {
+		if exists := m.SessionExists(sID); exists != (i >= 3) {
+			t.Error("Unexpected existence of session", i, exists)
+		}
+	}
+
+	// Growing a session evicts the other one
+	if err := m.UpdateSessionData(sIDs[3], largeData(8)); err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+	if m.SessionExists(sIDs[4]) || !m.SessionExists(sIDs[3]) {
+		t.Error("Expected the least recently updated session to be evicted")
+	}
+
+	// A single session exceeding the budget is kept on its own
+	sID, err := m.CreateSessionWithData(largeData(20))
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+	if count := m.ActiveSessionCount(); count != 1 || !m.SessionExists(sID) {
+		t.Error("Expected only the oversized session to remain, got", count)
+	}
+
+	if err = m.DeleteSession(sID); err != nil {
+		t.Fatal("Error DeleteSession:", err)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.totalBytes != 0 {
+		t.Error("Expected no bytes accounted without sessions, got", m.totalBytes)
+	}
+}
+
+func TestSessionManagersWaitUntilEmpty(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManagerWithTTL(time.Second, WithClock(clock))
+	defer m.Close()
+
+	if err := m.WaitUntilEmpty(context.Background()); err != nil {
+		t.Fatal("Error WaitUntilEmpty without sessions:", err)
+	}
+
+	var sIDs []string
+	for i := 0; i < 3; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.WaitUntilEmpty(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected WaitUntilEmpty to time out with sessions left, got", err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- m.WaitUntilEmpty(context.Background())
+	}()
+
+	// One session is deleted, the others expire
+	if err := m.DeleteSession(sIDs[0]); err != nil {
+		t.Fatal("Error DeleteSession:", err)
+	}
+	select {
+	case err := <-waitErr:
+		t.Fatal("WaitUntilEmpty returned with sessions left:", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Error("Error WaitUntilEmpty:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WaitUntilEmpty did not return after all sessions expired")
+	}
+
+	// Waiting on a closed manager would never end
+	if _, err := m.CreateSession(); err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	m.Close()
+	if err := m.WaitUntilEmpty(context.Background()); err != ErrManagerClosed {
+		t.Error("Expected ErrManagerClosed, got", err)
+	}
+}
+
+func TestSessionManagersSessionView(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	if _, err := m.GetSessionView("unknown"); err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound for unknown session, got", err)
+	}
+
+	sID, err := m.CreateSessionWithData(map[string]interface{}{
+		"website": "longhoang.de",
+		"visits":  3,
+	})
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+	view, err := m.GetSessionView(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionView:", err)
+	}
+
+	if website, err := view.GetString("website"); err != nil || website != "longhoang.de" {
+		t.Error("Unexpected website", website, err)
+	}
+	if visits, err := view.GetInt("visits"); err != nil || visits != 3 {
+		t.Error("Unexpected visits", visits, err)
+	}
+	if _, err := view.GetInt("website"); err != ErrTypeMismatch {
+		t.Error("Expected ErrTypeMismatch for string read as int, got", err)
+	}
+	if _, err := view.GetString("visits"); err != ErrTypeMismatch {
+		t.Error("Expected ErrTypeMismatch for int read as string, got", err)
+	}
+	if _, err := view.Get("missing"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing key, got", err)
+	}
+	if _, err := view.GetString("missing"); err != ErrKeyNotFound {
+		t.Error("Expected ErrKeyNotFound for missing string, got", err)
+	}
+
+	// The view reads the live data
+	if err = m.UpdateSessionField(sID, "visits", 4); err != nil {
+		t.Fatal("Error UpdateSessionField:", err)
+	}
+	if visits, err := view.GetInt("visits"); err != nil || visits != 4 {
+		t.Error("View does not see updated visits", visits, err)
+	}
+
+	if err = m.DeleteSession(sID); err != nil {
+		t.Fatal("Error DeleteSession:", err)
+	}
+	if _, err := view.Get("website"); err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound for deleted session, got", err)
+	}
+}
+
+func TestSessionManagersExpirationJitter(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(
+		WithClock(clock),
+		WithExpirationJitter(500*time.Millisecond),
+		WithExpirationCheckInterval(100*time.Millisecond),
+	)
+	defer m.Close()
+
+	var mu sync.Mutex
+	expired := 0
+	m.OnExpire(func(string, map[string]interface{}) {
+		mu.Lock()
+		expired++
+		mu.Unlock()
+	})
+
+	for i := 0; i < 1000; i++ {
+		if _, err := m.CreateSession(); err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+	}
+
+	// Nothing expires before ttl - jitter
+	clock.Advance(defaultTTL - 500*time.Millisecond)
+	mu.Lock()
+	if expired != 0 {
+		t.Error("Sessions expired before ttl - jitter:", expired)
+	}
+	mu.Unlock()
+
+	// The sessions expire across several checks rather than all at once
+	var steps, largest int
+	before := 0
+	for i := 0; i < 12; i++ {
+		clock.Advance(100 * time.Millisecond)
+		mu.Lock()
+		if n := expired - before; n > 0 {
+			steps++
+			if n > largest {
+				largest = n
+			}
+		}
+		before = expired
+		mu.Unlock()
+	}
+	if before != 1000 {
+		t.Error("Expected all sessions to expire by ttl + jitter, expired", before)
+	}
+	if steps < 5 || largest > 500 {
+		t.Errorf("Expected expirations to spread, got %d checks with at most %d", steps, largest)
+	}
+}
+
+// capturingLogger records every message it receives
+type capturingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *capturingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func TestSessionManagersLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithLogger(logger))
+
+	deleted, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	if err = m.DeleteSession(deleted); err != nil {
+		t.Fatal("Error DeleteSession:", err)
+	}
+	expired, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.Advance(defaultTTL + 2*time.Second)
+	m.Close()
+
+	expected := []string{
+		"Session " + deleted + " created",
+		"Session " + deleted + " deleted",
+		"Session " + expired + " created",
+		"Session " + expired + " expired",
+		"SessionManager closed",
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.messages) != len(expected) {
+		t.Fatal("Unexpected messages", logger.messages)
+	}
+	for i, msg := range expected {
+		if logger.messages[i] != msg {
+			t.Errorf("Expected message %q, got %q", msg, logger.messages[i])
+		}
+	}
+}
+
+func TestSessionManagersRepeatedUpdates(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Second)
+		err = m.UpdateSessionData(sID, map[string]interface{}{"visits": i})
+		if err != nil {
+			t.Fatal("Error UpdateSessionData:", err)
+		}
+	}
+
+	// Every update re-arms the same heap entry
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.expiries.entries) != 1 {
+		t.Error("Expected a single expiry entry, got", len(m.expiries.entries))
+	}
+	if len(m.expiries.index) != 1 {
+		t.Error("Expected the session once in the expiry index, got", len(m.expiries.index))
+	}
+}
+
+func TestSessionManagersGetOrCreateSession(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	var created int32
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, isNew, err := m.GetOrCreateSession("client-id")
+			if err != nil {
+				t.Error("Error GetOrCreateSession:", err)
+				return
+			}
+			if len(data) != 0 {
+				t.Error("Expected empty data, got", data)
+			}
+			if isNew {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Error("Expected exactly one creation, got", created)
+	}
+	if count := m.ActiveSessionCount(); count != 1 {
+		t.Error("Expected one session, got", count)
+	}
+
+	if err := m.UpdateSessionField("client-id", "website", "longhoang.de"); err != nil {
+		t.Fatal("Error UpdateSessionField:", err)
+	}
+	data, isNew, err := m.GetOrCreateSession("client-id")
+	if err != nil || isNew || data["website"] != "longhoang.de" {
+		t.Error("Unexpected existing session", data, isNew, err)
+	}
+
+	m.Close()
+	if _, _, err = m.GetOrCreateSession("other-id"); err != ErrManagerClosed {
+		t.Error("Expected ErrManagerClosed, got", err)
+	}
+}
+
+func TestSessionManagersSessionsExpiringWithin(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	var sIDs []string
+	for _, ttl := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		sID, err := m.CreateSessionWithTTL(ttl)
+		if err != nil {
+			t.Fatal("Error CreateSessionWithTTL:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+
+	expiring := make(map[string]bool)
+	for _, sID := range m.SessionsExpiringWithin(3 * time.Second) {
+		expiring[sID] = true
+	}
+	if len(expiring) != 2 || !expiring[sIDs[0]] || !expiring[sIDs[1]] {
+		t.Error("Expected the sessions with 1s and 2s ttl to expire within 3s, got", expiring)
+	}
+
+	if expiring := m.SessionsExpiringWithin(500 * time.Millisecond); len(expiring) != 0 {
+		t.Error("Expected no session to expire within 500ms, got", expiring)
+	}
+	if expiring := m.SessionsExpiringWithin(10 * time.Second); len(expiring) != 4 {
+		t.Error("Expected all sessions to expire within 10s, got", expiring)
+	}
+}
+
+func TestSessionManagersClear(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	expired := false
+	m.OnExpire(func(string, map[string]interface{}) { expired = true })
+
+	for i := 0; i < 5; i++ {
+		if _, err := m.CreateSession(); err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+	}
+	m.Clear()
+
+	if count := m.ActiveSessionCount(); count != 0 {
+		t.Error("Expected no sessions after Clear, got", count)
+	}
+	if stats := m.Stats(); stats.DeletedTotal != 5 || stats.CurrentActive != 0 {
+		t.Error("Unexpected stats after Clear", stats)
+	}
+
+	// The worker keeps expiring new sessions
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.Advance(defaultTTL + 2*time.Second)
+	if m.SessionExists(sID) {
+		t.Error("Session created after Clear did not expire")
+	}
+	if !expired {
+		t.Error("OnExpire not called for session created after Clear")
+	}
+}
+
+func TestSessionManagersPrune(t *testing.T) {
+	clock := newFakeClock()
+	// The worker never gets to check on its own
+	m := NewSessionManager(WithClock(clock), WithExpirationCheckInterval(time.Hour))
+	defer m.Close()
+
+	expiredID, err := m.CreateSessionWithTTL(time.Second)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	keptID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	if !m.SessionExists(expiredID) {
+		t.Fatal("Session removed without a check")
+	}
+	if n := m.Prune(); n != 1 {
+		t.Error("Expected Prune to remove 1 session, removed", n)
+	}
+	if m.SessionExists(expiredID) {
+		t.Error("Expired session still in memory after Prune")
+	}
+	if !m.SessionExists(keptID) {
+		t.Error("Session removed by Prune before it expired")
+	}
+	if n := m.Prune(); n != 0 {
+		t.Error("Expected nothing left to prune, removed", n)
+	}
+
+	m.Close()
+	if n := m.Prune(); n != 0 {
+		t.Error("Expected Prune to remove nothing after Close, removed", n)
+	}
+}
+
+func TestSessionManagersVersionConflict(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSessionWithData(map[string]interface{}{"visits": 0})
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+
+	// Both handlers read the same version before either writes back
+	var read sync.WaitGroup
+	read.Add(2)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			data, version, err := m.GetSessionWithVersion(sID)
+			read.Done()
+			if err != nil {
+				errs <- err
+				return
+			}
+			read.Wait()
+			data["visits"] = data["visits"].(int) + 1
+			errs <- m.UpdateSessionDataIfVersion(sID, data, version)
+		}()
+	}
+
+	var conflicts int
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case nil:
+		case ErrVersionConflict:
+			conflicts++
+		default:
+			t.Fatal("Error UpdateSessionDataIfVersion:", err)
+		}
+	}
+	if conflicts != 1 {
+		t.Error("Expected exactly one conflict, got", conflicts)
+	}
+
+	data, version, err := m.GetSessionWithVersion(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionWithVersion:", err)
+	}
+	if data["visits"] != 1 {
+		t.Error("Expected a single increment, got", data["visits"])
+	}
+
+	// Plain updates change the version as well
+	if err = m.UpdateSessionField(sID, "visits", 2); err != nil {
+		t.Fatal("Error UpdateSessionField:", err)
+	}
+	if err = m.UpdateSessionDataIfVersion(sID, data, version); err != ErrVersionConflict {
+		t.Error("Expected ErrVersionConflict after UpdateSessionField, got", err)
+	}
+}
+
+func TestSessionManagersCreationRateLimit(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithCreationRateLimit(5, time.Second))
+	defer m.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := m.CreateSessionFor("10.0.0.1"); err != nil {
+			t.Fatal("Error CreateSessionFor within the limit:", err)
+		}
+	}
+	if _, err := m.CreateSessionFor("10.0.0.1"); err != ErrRateLimited {
+		t.Error("Expected ErrRateLimited past the limit, got", err)
+	}
+
+	// Other keys are not affected
+	if _, err := m.CreateSessionFor("10.0.0.2"); err != nil {
+		t.Error("Error CreateSessionFor for another key:", err)
+	}
+
+	// A token is back after a fifth of the interval
+	clock.Advance(200 * time.Millisecond)
+	if _, err := m.CreateSessionFor("10.0.0.1"); err != nil {
+		t.Error("Error CreateSessionFor after refill:", err)
+	}
+	if _, err := m.CreateSessionFor("10.0.0.1"); err != ErrRateLimited {
+		t.Error("Expected ErrRateLimited after using the refilled token, got", err)
+	}
+
+	if count := m.ActiveSessionCount(); count != 7 {
+		t.Error("Expected 7 sessions, got", count)
+	}
+}
+
+func TestSessionManagersCreationRateLimitInvalid(t *testing.T) {
+	for _, opt := range []Option{
+		WithCreationRateLimit(0, time.Second),
+		WithCreationRateLimit(-1, time.Second),
+		WithCreationRateLimit(5, 0),
+		WithCreationRateLimit(5, -time.Second),
+	} {
+		m := NewSessionManager(opt)
+		if m.limiter != nil {
+			t.Error("Expected an invalid rate limit to be ignored")
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := m.CreateSessionFor("10.0.0.1"); err != nil {
+				t.Error("Error CreateSessionFor without a limit:", err)
+			}
+		}
+		m.Close()
+	}
+}
+
+func TestSessionManagersCreationRateLimitRefund(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithBackpressure(2, 1), WithCreationRateLimit(3, time.Hour))
+	defer m.Close()
+
+	var sIDs []string
+	for i := 0; i < 2; i++ {
+		sID, err := m.CreateSessionFor("10.0.0.1")
+		if err != nil {
+			t.Fatal("Error CreateSessionFor:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+	// Failed creations give their token back
+	for i := 0; i < 3; i++ {
+		if _, err := m.CreateSessionFor("10.0.0.1"); err != ErrManagerOverloaded {
+			t.Fatal("Expected ErrManagerOverloaded, got", err)
+		}
+	}
+
+	for _, sID := range sIDs {
+		if err := m.DeleteSession(sID); err != nil {
+			t.Fatal("Error DeleteSession:", err)
+		}
+	}
+	if _, err := m.CreateSessionFor("10.0.0.1"); err != nil {
+		t.Error("Error CreateSessionFor with the last token:", err)
+	}
+	if _, err := m.CreateSessionFor("10.0.0.1"); err != ErrRateLimited {
+		t.Error("Expected ErrRateLimited past the limit, got", err)
+	}
+}
+
+func TestSessionManagersCreationRateLimitConcurrent(t *testing.T) {
+	m := NewSessionManager(WithCreationRateLimit(50, time.Hour))
+	defer m.Close()
+
+	var created int32
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.CreateSessionFor("10.0.0.1")
+			if err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			} else if err != ErrRateLimited {
+				t.Error("Error CreateSessionFor:", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 50 {
+		t.Error("Expected 50 sessions within the limit, got", created)
+	}
+}
+
+func TestSessionManagersCreationRateLimitManyKeys(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithCreationRateLimit(5, time.Hour))
+	defer m.Close()
+	l := m.limiter
+
+	// None of the buckets refills meanwhile, so sweeping frees nothing
+	// and must not happen on every call
+	now := clock.Now()
+	keys := 3 * rateLimitSweepSize
+	for i := 0; i < keys; i++ {
+		if !l.allow(fmt.Sprint("key-", i), now) {
+			t.Fatal("Expected the first creation of a key to be allowed")
+		}
+	}
+	if l.sweepAt != 4*rateLimitSweepSize {
+		t.Errorf("Expected 2 sweeps doubling the threshold to %d, got %d", 4*rateLimitSweepSize, l.sweepAt)
+	}
+
+	// Once the buckets refilled, the next sweep forgets them but keeps
+	// the keys used since
+	now = now.Add(time.Hour)
+	for i := 0; i <= rateLimitSweepSize; i++ {
+		l.allow(fmt.Sprint("new-key-", i), now)
+	}
+	if len(l.buckets) != rateLimitSweepSize+1 {
+		t.Errorf("Expected %d keys left, got %d", rateLimitSweepSize+1, len(l.buckets))
+	}
+	if l.sweepAt != 2*rateLimitSweepSize {
+		t.Errorf("Expected the threshold to follow the keys left to %d, got %d", 2*rateLimitSweepSize, l.sweepAt)
+	}
+}
+
+func TestSessionManagersWorkerRecovers(t *testing.T) {
+	logger := &capturingLogger{}
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithLogger(logger))
+	defer m.Close()
+
+	if !m.LastSweepTime().IsZero() {
+		t.Error("Expected no sweep yet, got", m.LastSweepTime())
+	}
+
+	var mu sync.Mutex
+	var expired []string
+	m.OnExpire(func(sessionID string, _ map[string]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired = append(expired, sessionID)
+		if len(expired) == 1 {
+			panic("broken callback")
+		}
+	})
+
+	first, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.Advance(defaultTTL + 2*time.Second)
+	second, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.Advance(defaultTTL + 2*time.Second)
+
+	mu.Lock()
+	if len(expired) != 2 || expired[0] != first || expired[1] != second {
+		t.Error("Expected both sessions to expire despite the panic, got", expired)
+	}
+	mu.Unlock()
+	if last := m.LastSweepTime(); !last.Equal(clock.Now()) {
+		t.Error("Expected last sweep at", clock.Now(), "got", last)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	found := false
+	for _, msg := range logger.messages {
+		if msg == "Expiration sweep panicked: broken callback" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Panic not logged, got", logger.messages)
+	}
+}
+
+func TestSessionManagersLoadSnapshotExpiry(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+
+	soonID, err := m.CreateSessionWithTTL(time.Second)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	laterID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	snapshot := m.Snapshot()
+	m.Close()
+
+	// The restart takes 2 seconds
+	clock.Advance(2 * time.Second)
+
+	for _, preserveExpiry := range []bool{false, true} {
+		restored := NewSessionManager(WithClock(clock))
+		if err := restored.LoadSnapshot(snapshot, preserveExpiry); err != nil {
+			t.Fatal("Error LoadSnapshot:", err)
+		}
+
+		soonExpiry, _ := restored.GetSessionExpiry(soonID)
+		laterExpiry, _ := restored.GetSessionExpiry(laterID)
+		if preserveExpiry {
+			if !soonExpiry.Equal(snapshot[soonID].expireAt) || !laterExpiry.Equal(snapshot[laterID].expireAt) {
+				t.Error("Expected expiry to be preserved")
+			}
+		} else {
+			if !soonExpiry.Equal(clock.Now().Add(time.Second)) || !laterExpiry.Equal(clock.Now().Add(defaultTTL)) {
+				t.Error("Expected expiry to be reset to a full ttl from now")
+			}
+		}
+
+		// The session that expired during the restart is only kept when
+		// its ttl was reset
+		clock.Advance(time.Second)
+		if exists := restored.SessionExists(soonID); exists == preserveExpiry {
+			t.Errorf("Unexpected existence %v of expired session with preserveExpiry %v", exists, preserveExpiry)
+		}
+		if !restored.SessionExists(laterID) {
+			t.Error("Session removed before its expiry with preserveExpiry", preserveExpiry)
+		}
+		restored.Close()
+	}
+}
+
+func TestSessionManagersMiddleware(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	var seen []string
+	handler := Middleware(m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sID, ok := SessionFromContext(r)
+		if !ok {
+			t.Error("No session in request context")
+		}
+		seen = append(seen, sID)
+	}))
+
+	// The first request gets a new session
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookieName {
+		t.Fatal("Expected session cookie, got", cookies)
+	}
+	if !m.SessionExists(cookies[0].Value) {
+		t.Fatal("Session of cookie not found")
+	}
+
+	// The second request keeps it and renews its expiry
+	clock.Advance(3 * time.Second)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("Expected no new cookie for a known session")
+	}
+	if len(seen) != 2 || seen[0] != seen[1] || seen[0] != cookies[0].Value {
+		t.Error("Expected both requests to see the same session, got", seen)
+	}
+	expireAt, err := m.GetSessionExpiry(cookies[0].Value)
+	if err != nil {
+		t.Fatal("Error GetSessionExpiry:", err)
+	}
+	if !expireAt.Equal(clock.Now().Add(defaultTTL)) {
+		t.Error("Expected expiry renewed by the second request, got", expireAt)
+	}
+
+	// Unknown sessionIDs are replaced
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: "forged"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Value == "forged" {
+		t.Error("Expected a new session for an unknown sessionID, got", cookies)
+	}
+}
+
+func TestSessionManagersCloseAndFlush(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+
+	sID, err := m.CreateSessionWithData(map[string]interface{}{"website": "longhoang.de"})
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+	shortID, err := m.CreateSessionWithTTL(time.Second)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	expireAt, _ := m.GetSessionExpiry(sID)
+
+	var buf bytes.Buffer
+	if err = m.CloseAndFlush(&buf); err != nil {
+		t.Fatal("Error CloseAndFlush:", err)
+	}
+	if _, err = m.CreateSession(); err != ErrManagerClosed {
+		t.Error("Expected manager to be closed after CloseAndFlush, got", err)
+	}
+
+	restored := NewSessionManager(WithClock(clock))
+	defer restored.Close()
+	if err = restored.LoadFrom(&buf); err != nil {
+		t.Fatal("Error LoadFrom:", err)
+	}
+
+	data, err := restored.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if data["website"] != "longhoang.de" {
+		t.Error("Unexpected data after round trip", data)
+	}
+	if restoredExpireAt, _ := restored.GetSessionExpiry(sID); !restoredExpireAt.Equal(expireAt) {
+		t.Error("Expected expiry", expireAt, "after round trip, got", restoredExpireAt)
+	}
+
+	// The ttl survives the round trip as well
+	clock.Advance(2 * time.Second)
+	if restored.SessionExists(shortID) {
+		t.Error("Session with 1s ttl still in memory after 2s")
+	}
+
+	if err = restored.LoadFrom(strings.NewReader("not json")); err == nil {
+		t.Error("Expected error loading invalid data")
+	}
+}
+
+func TestSessionManagersUpdateSessionDataFunc(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	const goroutines = 50
+	const increments = 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				err := m.UpdateSessionDataFunc(sID, func(data map[string]interface{}) {
+					count, _ := data["count"].(int)
+					data["count"] = count + 1
+				})
+				if err != nil {
+					t.Error("Error UpdateSessionDataFunc:", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	if data["count"] != goroutines*increments {
+		t.Error("Expected no lost increments, got", data["count"])
+	}
+
+	err = m.UpdateSessionDataFunc("unknown", func(data map[string]interface{}) {})
+	if err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound for unknown session, got", err)
+	}
+}
+
+func TestSessionManagersCleanerSharedByManagers(t *testing.T) {
+	clock := newFakeClock()
+	before := runtime.NumGoroutine()
+
+	c := NewCleanerWithClock(time.Second, clock)
+	managers := make([]*SessionManager, 50)
+	sessionIDs := make([]string, len(managers))
+	for i := range managers {
+		managers[i] = NewSessionManager(WithClock(clock), WithCleaner(c))
+		sID, err := managers[i].CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sessionIDs[i] = sID
+	}
+
+	// Goroutines of earlier tests may still be exiting, so only more
+	// than one new goroutine is an error
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Error("Expected a single background goroutine for all managers, got", n)
+	}
+
+	clock.Advance(4 * time.Second)
+	for i, m := range managers {
+		if _, err := m.GetSessionData(sessionIDs[i]); err != nil {
+			t.Error("Error GetSessionData before expiry:", err)
+		}
+	}
+
+	clock.Advance(2 * time.Second)
+	for i, m := range managers {
+		if _, err := m.GetSessionData(sessionIDs[i]); err != ErrSessionNotFound {
+			t.Error("Expected session of manager", i, "to expire, got", err)
+		}
+	}
+
+	sID, err := managers[0].CreateSessionWithTTL(time.Millisecond)
+	if err != nil {
+		t.Fatal("Error CreateSessionWithTTL:", err)
+	}
+	clock.mu.Lock()
+	clock.now = clock.now.Add(time.Second)
+	clock.mu.Unlock()
+	if n := managers[0].Prune(); n != 1 {
+		t.Error("Expected Prune to remove the expired session, got", n)
+	}
+	if managers[0].SessionExists(sID) {
+		t.Error("Expected pruned session to be removed")
+	}
+
+	for _, m := range managers {
+		m.Close()
+	}
+	if n := managers[0].Prune(); n != 0 {
+		t.Error("Expected Prune of a closed manager to remove nothing, got", n)
+	}
+	c.Close()
+}
+
+func TestSessionManagersLazyExpiry(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithLazyExpiry())
+	defer m.Close()
+	eager := NewSessionManager(WithClock(clock))
+	defer eager.Close()
+
+	var expired []string
+	m.OnExpire(func(sessionID string, data map[string]interface{}) {
+		expired = append(expired, sessionID)
+	})
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	eagerID, err := eager.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	// Move past the expiry without firing a tick, so no sweep runs
+	clock.mu.Lock()
+	clock.now = clock.now.Add(defaultTTL + time.Millisecond)
+	clock.mu.Unlock()
+
+	if _, err := eager.GetSessionData(eagerID); err != nil {
+		t.Error("Expected session to be returned until swept without lazy expiry, got", err)
+	}
+	if _, err := m.GetSessionData(sID); err != ErrSessionNotFound {
+		t.Error("Expected expired session not to be returned, got", err)
+	}
+	if m.SessionExists(sID) {
+		t.Error("Expected expired session to be removed on read")
+	}
+	// The worker notifies in between sweeps, so Prune waits for it
+	if n := m.Prune(); n != 0 {
+		t.Error("Expected nothing left to sweep, got", n)
+	}
+	if len(expired) != 1 || expired[0] != sID {
+		t.Error("Expected OnExpire for the lazily expired session, got", expired)
+	}
+	if stats := m.Stats(); stats.ExpiredTotal != 1 || stats.CurrentActive != 0 {
+		t.Error("Expected lazily expired session to count as expired", stats)
+	}
+}
+
+func TestSessionManagersLazyExpiryAllPaths(t *testing.T) {
+	notFound := func(ok bool) error {
+		if ok {
+			return nil
+		}
+		return ErrSessionNotFound
+	}
+	calls := map[string]func(m *SessionManager, sID string, view *SessionView) error{
+		"Touch": func(m *SessionManager, sID string, view *SessionView) error {
+			return m.Touch(sID)
+		},
+		"UpdateSessionData": func(m *SessionManager, sID string, view *SessionView) error {
+			return m.UpdateSessionData(sID, map[string]interface{}{"visits": 1})
+		},
+		"UpdateSessionField": func(m *SessionManager, sID string, view *SessionView) error {
+			return m.UpdateSessionField(sID, "visits", 1)
+		},
+		"UpdateSessionDataFunc": func(m *SessionManager, sID string, view *SessionView) error {
+			return m.UpdateSessionDataFunc(sID, func(data map[string]interface{}) { data["visits"] = 1 })
+		},
+		"UpdateSessionDataIfVersion": func(m *SessionManager, sID string, view *SessionView) error {
+			return m.UpdateSessionDataIfVersion(sID, map[string]interface{}{"visits": 1}, 1)
+		},
+		"ExtendSession": func(m *SessionManager, sID string, view *SessionView) error {
+			return m.ExtendSession(sID, time.Minute)
+		},
+		"SessionExists": func(m *SessionManager, sID string, view *SessionView) error {
+			return notFound(m.SessionExists(sID))
+		},
+		"GetSessionView": func(m *SessionManager, sID string, view *SessionView) error {
+			_, err := m.GetSessionView(sID)
+			return err
+		},
+		"GetSessionWithVersion": func(m *SessionManager, sID string, view *SessionView) error {
+			_, _, err := m.GetSessionWithVersion(sID)
+			return err
+		},
+		"SessionView.Get": func(m *SessionManager, sID string, view *SessionView) error {
+			_, err := view.Get("visits")
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		clock := newFakeClock()
+		m := NewSessionManager(WithClock(clock), WithLazyExpiry())
+		expired := 0
+		m.OnExpire(func(string, map[string]interface{}) { expired++ })
+
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		// The view is taken before the session expires
+		view, err := m.GetSessionView(sID)
+		if err != nil {
+			t.Fatal("Error GetSessionView:", err)
+		}
+
+		// Move past the expiry without firing a tick, so no sweep runs
+		clock.mu.Lock()
+		clock.now = clock.now.Add(defaultTTL + time.Millisecond)
+		clock.mu.Unlock()
+
+		if err := call(m, sID, view); err != ErrSessionNotFound {
+			t.Errorf("%s: Expected ErrSessionNotFound for an expired session, got %v", name, err)
+		}
+		m.Prune()
+		if expired != 1 {
+			t.Errorf("%s: Expected OnExpire once for the lazily expired session, got %d", name, expired)
+		}
+		m.mu.RLock()
+		if _, ok := m.sessions[sID]; ok {
+			t.Errorf("%s: Expected expired session to be removed", name)
+		}
+		m.mu.RUnlock()
+		m.Close()
+	}
+}
+
+func TestSessionManagersLazyExpiryGetOrCreateSession(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithLazyExpiry())
+	defer m.Close()
+	expired := 0
+	m.OnExpire(func(string, map[string]interface{}) { expired++ })
+
+	data, _, err := m.GetOrCreateSession("session")
+	if err != nil {
+		t.Fatal("Error GetOrCreateSession:", err)
+	}
+	data["visits"] = 1
+	if err := m.UpdateSessionData("session", data); err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+
+	clock.mu.Lock()
+	clock.now = clock.now.Add(defaultTTL + time.Millisecond)
+	clock.mu.Unlock()
+
+	data, created, err := m.GetOrCreateSession("session")
+	if err != nil {
+		t.Fatal("Error GetOrCreateSession:", err)
+	}
+	if !created || len(data) != 0 {
+		t.Error("Expected an expired session to be replaced by a new one", created, data)
+	}
+	m.Prune()
+	if expired != 1 {
+		t.Error("Expected OnExpire for the replaced session, got", expired)
+	}
+}
+
+func TestSessionManagersLazyExpiryNeverBlocksReads(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithLazyExpiry(), WithExpirationsOverflow(1, OverflowBlock))
+	defer m.Close()
+	onExpire := make(chan string, 3)
+	m.OnExpire(func(sessionID string, data map[string]interface{}) {
+		onExpire <- sessionID
+	})
+
+	var sIDs []string
+	for i := 0; i < 3; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+	clock.mu.Lock()
+	clock.now = clock.now.Add(defaultTTL + time.Millisecond)
+	clock.mu.Unlock()
+
+	// Nobody reads Expirations, which only holds one of them
+	start := time.Now()
+	for _, sID := range sIDs {
+		if _, err := m.GetSessionData(sID); err != ErrSessionNotFound {
+			t.Error("Expected expired session not to be returned, got", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Expected lazy expiry not to block reads on a full Expirations channel", elapsed)
+	}
+
+	// The worker still delivers every expiration once they are read
+	for range sIDs {
+		select {
+		case <-m.Expirations():
+		case <-time.After(time.Second):
+			t.Fatal("Expiration of a lazily expired session not delivered")
+		}
+	}
+	for range sIDs {
+		select {
+		case <-onExpire:
+		case <-time.After(time.Second):
+			t.Fatal("OnExpire not called for a lazily expired session")
+		}
+	}
+}
+
+func TestSessionManagersLazyExpiryWithCleaner(t *testing.T) {
+	clock := newFakeClock()
+	c := NewCleanerWithClock(time.Second, clock)
+	defer c.Close()
+	m := NewSessionManager(WithClock(clock), WithCleaner(c), WithLazyExpiry())
+	defer m.Close()
+	var expired []string
+	m.OnExpire(func(sessionID string, data map[string]interface{}) {
+		expired = append(expired, sessionID)
+	})
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.mu.Lock()
+	clock.now = clock.now.Add(defaultTTL + time.Millisecond)
+	clock.mu.Unlock()
+
+	if _, err := m.GetSessionData(sID); err != ErrSessionNotFound {
+		t.Error("Expected expired session not to be returned, got", err)
+	}
+	// The cleaner notifies on its next sweep
+	if n := m.Prune(); n != 0 {
+		t.Error("Expected nothing left to sweep, got", n)
+	}
+	if len(expired) != 1 || expired[0] != sID {
+		t.Error("Expected OnExpire on the cleaner's sweep, got", expired)
+	}
+}
+
+func TestSessionManagersLifecycleHooks(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	var mu sync.Mutex
+	events := make(map[string][]string)
+	record := func(event string) func(sessionID string) {
+		return func(sessionID string) {
+			mu.Lock()
+			defer mu.Unlock()
+			events[event] = append(events[event], sessionID)
+		}
+	}
+	m.OnCreate(record("create"))
+	m.OnUpdate(func(sessionID string) {
+		// Runs outside of the lock, so the manager can be used
+		if !m.SessionExists(sessionID) {
+			t.Error("Expected updated session to exist")
+		}
+		record("update")(sessionID)
+	})
+	m.OnExpire(func(sessionID string, data map[string]interface{}) {
+		record("expire")(sessionID)
+	})
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	if err := m.UpdateSessionData(sID, map[string]interface{}{"website": "longhoang.de"}); err != nil {
+		t.Fatal("Error UpdateSessionData:", err)
+	}
+	if err := m.UpdateSessionData("unknown", nil); err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound, got", err)
+	}
+	clock.Advance(defaultTTL + 2*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, event := range []string{"create", "update", "expire"} {
+		if len(events[event]) != 1 || events[event][0] != sID {
+			t.Error("Expected a single", event, "event for the session, got", events[event])
+		}
+	}
+}
+
+func TestSessionManagersTryCreateSession(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	m.mu.RLock()
+	start := time.Now()
+	sID, ok, err := m.TryCreateSession()
+	m.mu.RUnlock()
+	if ok || err != nil || sID != "" {
+		t.Error("Expected TryCreateSession to fail while the lock is held", sID, ok, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("Expected TryCreateSession not to block", elapsed)
+	}
+	if n := m.ActiveSessionCount(); n != 0 {
+		t.Error("Expected no session to be created, got", n)
+	}
+
+	sID, ok, err = m.TryCreateSession()
+	if !ok || err != nil {
+		t.Fatal("Expected TryCreateSession to succeed without contention", ok, err)
+	}
+	if !m.SessionExists(sID) {
+		t.Error("Expected created session to exist")
+	}
+
+	m.Close()
+	if _, ok, err := m.TryCreateSession(); !ok || err != ErrManagerClosed {
+		t.Error("Expected ErrManagerClosed after Close", ok, err)
+	}
+}
+
+func TestSessionManagersMaxLifetime(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManagerWithLifetime(5*time.Second, 8*time.Second, WithClock(clock))
+	defer m.Close()
+
+	created := clock.Now()
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	// Kept active, so the idle timeout never fires
+	for i := 0; i < 3; i++ {
+		clock.Advance(2 * time.Second)
+		if err := m.Touch(sID); err != nil {
+			t.Fatal("Error Touch before the lifetime ended:", err)
+		}
+	}
+	expiry, err := m.GetSessionExpiry(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionExpiry:", err)
+	}
+	if !expiry.Equal(created.Add(8 * time.Second)) {
+		t.Error("Expected the expiry to be capped at the lifetime, got", expiry.Sub(created))
+	}
+
+	clock.Advance(3 * time.Second)
+	if m.SessionExists(sID) {
+		t.Error("Expected session kept active to expire at its lifetime")
+	}
+
+	// A session left idle still expires on the idle timeout
+	idleID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	clock.Advance(6 * time.Second)
+	if m.SessionExists(idleID) {
+		t.Error("Expected idle session to expire on the idle timeout")
+	}
+}
+
+func TestSessionManagersSessionsByTag(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	create := func(tenant string) string {
+		sID, err := m.CreateSessionWithTags(map[string]string{"tenant": tenant, "role": "user"})
+		if err != nil {
+			t.Fatal("Error CreateSessionWithTags:", err)
+		}
+		return sID
+	}
+	first := create("acme")
+	clock.Advance(3 * time.Second)
+	second := create("acme")
+	other := create("globex")
+
+	ordered := func(ids []string) []string {
+		if len(ids) == 2 && ids[0] > ids[1] {
+			ids[0], ids[1] = ids[1], ids[0]
+		}
+		return ids
+	}
+	want := ordered([]string{first, second})
+	if got := ordered(m.SessionsByTag("tenant", "acme")); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Error("Expected both acme sessions, got", got)
+	}
+	if got := m.SessionsByTag("tenant", "globex"); len(got) != 1 || got[0] != other {
+		t.Error("Expected the globex session, got", got)
+	}
+	if got := m.SessionsByTag("tenant", "initech"); len(got) != 0 {
+		t.Error("Expected no sessions for an unknown tag, got", got)
+	}
+
+	// The first session expires, the others are kept active
+	clock.Advance(3 * time.Second)
+	if err := m.Touch(second); err != nil {
+		t.Fatal("Error Touch:", err)
+	}
+	if err := m.DeleteSession(other); err != nil {
+		t.Fatal("Error DeleteSession:", err)
+	}
+	if got := m.SessionsByTag("tenant", "acme"); len(got) != 1 || got[0] != second {
+		t.Error("Expected only the active acme session, got", got)
+	}
+	if got := m.SessionsByTag("role", "user"); len(got) != 1 || got[0] != second {
+		t.Error("Expected only the active session by role, got", got)
+	}
+
+	clock.Advance(defaultTTL + 2*time.Second)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.tagIndex) != 0 {
+		t.Error("Expected the tag index to be empty once all sessions expired", m.tagIndex)
+	}
+}
+
+// expireOnePerSweep creates three sessions a second apart and lets them
+// expire, each on its own sweep, and returns their ids in order
+func expireOnePerSweep(t *testing.T, m *SessionManager, clock *fakeClock) []string {
+	var sIDs []string
+	for i := 0; i < 3; i++ {
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		sIDs = append(sIDs, sID)
+		clock.Advance(time.Second)
+	}
+	clock.Advance(defaultTTL)
+	return sIDs
+}
+
+func TestSessionManagersExpirationsOverflowDropNewest(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithExpirationsOverflow(1, OverflowDropNewest))
+
+	sIDs := expireOnePerSweep(t, m, clock)
+	m.Close()
+
+	var got []string
+	for sID := range m.Expirations() {
+		got = append(got, sID)
+	}
+	if len(got) != 1 || got[0] != sIDs[0] {
+		t.Error("Expected only the first expiration to be kept, got", got)
+	}
+}
+
+func TestSessionManagersExpirationsOverflowDropOldest(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithExpirationsOverflow(1, OverflowDropOldest))
+
+	sIDs := expireOnePerSweep(t, m, clock)
+	m.Close()
+
+	var got []string
+	for sID := range m.Expirations() {
+		got = append(got, sID)
+	}
+	if len(got) != 1 || got[0] != sIDs[2] {
+		t.Error("Expected only the last expiration to be kept, got", got)
+	}
+}
+
+func TestSessionManagersExpirationsOverflowBlock(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithExpirationsOverflow(1, OverflowBlock))
+
+	received := make(chan []string)
+	go func() {
+		var got []string
+		for sID := range m.Expirations() {
+			// A slow consumer
+			time.Sleep(50 * time.Millisecond)
+			got = append(got, sID)
+		}
+		received <- got
+	}()
+
+	sIDs := expireOnePerSweep(t, m, clock)
+	// Buffered expirations are still received after Close
+	m.Close()
+
+	got := <-received
+	if len(got) != 3 || got[0] != sIDs[0] || got[1] != sIDs[1] || got[2] != sIDs[2] {
+		t.Error("Expected every expiration in order, got", got)
+	}
+}
+
+func TestSessionManagersExpirationsOverflowBlockClose(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithExpirationsOverflow(1, OverflowBlock))
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.CreateSession(); err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+	}
+	clock.mu.Lock()
+	clock.now = clock.now.Add(2 * defaultTTL)
+	clock.mu.Unlock()
+
+	// Nobody reads, so the sweep gets stuck on the second expiration
+	pruned := make(chan int)
+	go func() {
+		pruned <- m.Prune()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on a stuck consumer")
+	}
+	if n := <-pruned; n != 2 {
+		t.Error("Expected the stuck sweep to finish on Close, got", n)
+	}
+}
+
+func TestSessionManagersExpirationsUnbuffered(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowDropNewest, OverflowDropOldest} {
+		clock := newFakeClock()
+		m := NewSessionManager(WithClock(clock), WithExpirationsOverflow(0, policy))
+
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession:", err)
+		}
+		clock.mu.Lock()
+		clock.now = clock.now.Add(2 * defaultTTL)
+		clock.mu.Unlock()
+
+		// Falls back to blocking, so the expiration waits for the reader
+		pruned := make(chan int)
+		go func() {
+			pruned <- m.Prune()
+		}()
+		select {
+		case got := <-m.Expirations():
+			if got != sID {
+				t.Errorf("Policy %d: Expected expiration of %s, got %s", policy, sID, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Policy %d: Expiration not delivered on an unbuffered channel", policy)
+		}
+		if n := <-pruned; n != 1 {
+			t.Errorf("Policy %d: Expected 1 session pruned, got %d", policy, n)
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			m.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("Policy %d: Close blocked with an unbuffered channel", policy)
+		}
+	}
+}
+
+func TestSessionManagersMigrateSessions(t *testing.T) {
+	clock := newFakeClock()
+	source := NewSessionManager(WithClock(clock))
+	defer source.Close()
+	target := NewSessionManager(WithClock(clock))
+	defer target.Close()
+
+	var sIDs []string
+	for i := 0; i < 10; i++ {
+		sID, err := source.CreateSessionWithData(map[string]interface{}{"i": i})
+		if err != nil {
+			t.Fatal("Error CreateSessionWithData:", err)
+		}
+		sIDs = append(sIDs, sID)
+	}
+	expiry, err := source.GetSessionExpiry(sIDs[0])
+	if err != nil {
+		t.Fatal("Error GetSessionExpiry:", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	migrated := append([]string{"unknown"}, sIDs[:5]...)
+	if err := target.ImportSessions(source.ExportFor(migrated, true), true); err != nil {
+		t.Fatal("Error ImportSessions:", err)
+	}
+
+	for i, sID := range sIDs {
+		if exists := source.SessionExists(sID); exists != (i >= 5) {
+			t.Error("Unexpected existence of session", i, "in the source", exists)
+		}
+		data, err := target.GetSessionData(sID)
+		if i >= 5 {
+			if err != ErrSessionNotFound {
+				t.Error("Expected session", i, "to stay in the source only, got", err)
+			}
+			continue
+		}
+		if err != nil || data["i"] != i {
+			t.Error("Expected migrated session", i, "in the target", data, err)
+		}
+	}
+	if got, err := target.GetSessionExpiry(sIDs[0]); err != nil || !got.Equal(expiry) {
+		t.Error("Expected the expiry to be preserved", got, err)
+	}
+	if n := target.ActiveSessionCount(); n != 5 {
+		t.Error("Expected 5 sessions in the target, got", n)
+	}
+
+	// Without remove the sessions stay in the source
+	if exported := source.ExportFor(sIDs[5:], false); len(exported) != 5 || source.ActiveSessionCount() != 5 {
+		t.Error("Expected an export without remove to keep the sessions", len(exported))
+	}
+}
+
+func TestSessionManagersExtendSession(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	other, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+
+	clock.Advance(2 * time.Second)
+	if err := m.ExtendSession(sID, 10*time.Second); err != nil {
+		t.Fatal("Error ExtendSession:", err)
+	}
+
+	clock.Advance(defaultTTL + 2*time.Second)
+	if m.SessionExists(other) {
+		t.Error("Expected session without extension to expire")
+	}
+	if !m.SessionExists(sID) {
+		t.Error("Expected extended session to survive past the ttl")
+	}
+
+	// It expires 15s after creation
+	clock.Advance(7 * time.Second)
+	if m.SessionExists(sID) {
+		t.Error("Expected extended session to expire once the extension is over")
+	}
+
+	if err := m.ExtendSession(sID, time.Second); err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound, got", err)
+	}
+}
+
+func TestSessionManagersExtendSessionMaxLifetime(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManagerWithLifetime(defaultTTL, 10*time.Second, WithClock(clock))
+	defer m.Close()
+
+	sID, err := m.CreateSession()
+	if err != nil {
+		t.Fatal("Error CreateSession:", err)
+	}
+	created := clock.Now()
+
+	if err := m.ExtendSession(sID, time.Minute); err != nil {
+		t.Fatal("Error ExtendSession:", err)
+	}
+	expireAt, err := m.GetSessionExpiry(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionExpiry:", err)
+	}
+	if want := created.Add(10 * time.Second); !expireAt.Equal(want) {
+		t.Errorf("Expected the extension capped at the deadline %v, got %v", want, expireAt)
+	}
+
+	clock.Advance(12 * time.Second)
+	if m.SessionExists(sID) {
+		t.Error("Expected extended session to expire at its maximum lifetime")
+	}
+}
+
+func TestSessionManagersGetSessionDataUnsafe(t *testing.T) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	sID, err := m.CreateSessionWithData(map[string]interface{}{"website": "longhoang.de", "visits": 3})
+	if err != nil {
+		t.Fatal("Error CreateSessionWithData:", err)
+	}
+
+	safe, err := m.GetSessionData(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionData:", err)
+	}
+	unsafe, err := m.GetSessionDataUnsafe(sID)
+	if err != nil {
+		t.Fatal("Error GetSessionDataUnsafe:", err)
+	}
+	if len(unsafe) != len(safe) || unsafe["website"] != safe["website"] || unsafe["visits"] != safe["visits"] {
+		t.Error("Expected the same data from both getters", safe, unsafe)
+	}
+
+	if _, err := m.GetSessionDataUnsafe("unknown"); err != ErrSessionNotFound {
+		t.Error("Expected ErrSessionNotFound, got", err)
+	}
+}
+
+func benchmarkGetSessionData(b *testing.B, get func(m *SessionManager, sID string) (map[string]interface{}, error)) {
+	m := NewSessionManager()
+	defer m.Close()
+
+	data := make(map[string]interface{}, 20)
+	for i := 0; i < 20; i++ {
+		data[strconv.Itoa(i)] = i
+	}
+	sID, err := m.CreateSessionWithData(data)
+	if err != nil {
+		b.Fatal("Error CreateSessionWithData:", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := get(m, sID); err != nil {
+			b.Fatal("Error getting session data:", err)
+		}
+	}
+}
+
+func BenchmarkGetSessionData(b *testing.B) {
+	benchmarkGetSessionData(b, (*SessionManager).GetSessionData)
+}
+
+func BenchmarkGetSessionDataUnsafe(b *testing.B) {
+	benchmarkGetSessionData(b, (*SessionManager).GetSessionDataUnsafe)
+}
+
+func TestSessionManagersBackpressure(t *testing.T) {
+	clock := newFakeClock()
+	m := NewSessionManager(WithClock(clock), WithBackpressure(10, 5))
+	defer m.Close()
+
+	var later []string
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			clock.Advance(2 * time.Second)
+		}
+		sID, err := m.CreateSession()
+		if err != nil {
+			t.Fatal("Error CreateSession below the high-water mark:", err)
+		}
+		if i >= 5 {
+			later = append(later, sID)
+		}
+	}
+
+	if _, err := m.CreateSession(); err != ErrManagerOverloaded {
+		t.Error("Expected ErrManagerOverloaded at the high-water mark, got", err)
+	}
+	if _, _, err := m.GetOrCreateSession("new"); err != ErrManagerOverloaded {
+		t.Error("Expected GetOrCreateSession to be overloaded as well, got", err)
+	}
+
+	// Still above the low-water mark
+	for _, sID := range later[:3] {
+		if err := m.DeleteSession(sID); err != nil {
+			t.Fatal("Error DeleteSession:", err)
+		}
+	}
+	if _, err := m.CreateSession(); err != ErrManagerOverloaded {
+		t.Error("Expected ErrManagerOverloaded above the low-water mark, got", err)
+	}
+
+	// The first five sessions expire
+	clock.Advance(4 * time.Second)
+	if n := m.ActiveSessionCount(); n != 2 {
+		t.Fatal("Expected 2 sessions to remain, got", n)
+	}
+	if _, err := m.CreateSession(); err != nil {
+		t.Error("Expected CreateSession to recover below the low-water mark, got", err)
+	}
+}
+
+func TestSessionManagersEvictionOrder(t *testing.T) {
+	clock := newFakeClock()
+	byPriority := func(a, b Session) bool {
+		pa, _ := a.Data["priority"].(int)
+		pb, _ := b.Data["priority"].(int)
+		return pa < pb
+	}
+	m := NewSessionManager(WithClock(clock), WithMaxSessions(3), WithEvictionOrder(byPriority))
+	defer m.Close()
+
+	create := func(priority int) string {
+		sID, err := m.CreateSessionWithData(map[string]interface{}{"priority": priority})
+		if err != nil {
+			t.Fatal("Error CreateSessionWithData:", err)
+		}
+		clock.Advance(10 * time.Millisecond)
+		return sID
+	}
+	premium := create(2)
+	guest := create(0)
+	regular := create(1)
+
+	// The guest goes first although the premium session is the oldest
+	newer := create(2)
+	if m.SessionExists(guest) {
+		t.Error("Expected the guest session to be evicted first")
+	}
+	if !m.SessionExists(premium) || !m.SessionExists(regular) || !m.SessionExists(newer) {
+		t.Error("Expected the sessions with higher priority to be kept")
+	}
+
+	// Updates reorder the sessions
+	if err := m.UpdateSessionField(premium, "priority", -1); err != nil {
+		t.Fatal("Error UpdateSessionField:", err)
+	}
+	create(3)
+	if m.SessionExists(premium) || !m.SessionExists(regular) {
+		t.Error("Expected the downgraded session to be evicted next")
+	}
+
+	m.Clear()
+	create(1)
+	if n := m.ActiveSessionCount(); n != 1 {
+		t.Error("Expected eviction order to keep working after Clear, got", n)
+	}
+}
+
+func BenchmarkSessionMemory(b *testing.B) {
+	const sessions = 10000
+
+	var perSession float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		// Spread the expiries, so that they do not all share the same
+		// interval
+		m := NewSessionManager(WithClock(newFakeClock()))
+		for j := 0; j < sessions; j++ {
+			if _, err := m.CreateSessionWithTTL(defaultTTL + time.Duration(j)*time.Millisecond); err != nil {
+				b.Fatal("Error CreateSessionWithTTL:", err)
+			}
+		}
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		perSession = float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / sessions
+		runtime.KeepAlive(m)
+		m.Close()
+	}
+	b.ReportMetric(perSession, "B/session")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Cleaner removes the expired sessions of many SessionManagers from a
+// single goroutine, e.g. of one manager per tenant, instead of a
+// worker and a ticker per manager. Managers created WithCleaner
+// register on creation and deregister on Close.
+type Cleaner struct {
+	ticker     Ticker
+	register   chan *SessionManager
+	deregister chan *SessionManager
+	prune      chan pruneRequest
+
+	closeOnce  sync.Once
+	done       chan struct{}
+	workerDone chan struct{}
+}
+
+// pruneRequest asks the Cleaner for a sweep of one manager
+type pruneRequest struct {
+	m      *SessionManager
+	pruned chan<- int
+}
+
+// NewCleaner creates a Cleaner which looks for expired sessions every
+// interval. The interval must be positive.
+func NewCleaner(interval time.Duration) *Cleaner {
+	return NewCleanerWithClock(interval, realClock{})
+}
+
+// NewCleanerWithClock is like NewCleaner but takes the time from
+// clock, e.g. a fake clock in tests
+func NewCleanerWithClock(interval time.Duration, clock Clock) *Cleaner {
+	c := &Cleaner{
+		ticker:     clock.NewTicker(interval),
+		register:   make(chan *SessionManager),
+		deregister: make(chan *SessionManager),
+		prune:      make(chan pruneRequest),
+		done:       make(chan struct{}),
+		workerDone: make(chan struct{}),
+	}
+
+	go c.worker()
+
+	return c
+}
+
+// WithCleaner makes the manager's sessions expire on the sweeps of c
+// rather than on a worker of its own, the expiration check interval of
+// the manager is not used then. c must not be closed before the
+// manager.
+func WithCleaner(c *Cleaner) Option {
+	return func(m *SessionManager) {
+		m.cleaner = c
+	}
+}
+
+// Close stops the cleaner's goroutine and waits for it to return.
+// Sessions of managers still registered no longer expire afterwards.
+// Calling Close more than once is a no-op.
+func (c *Cleaner) Close() {
+	c.closeOnce.Do(func() {
+		c.ticker.Stop()
+		close(c.done)
+		<-c.workerDone
+	})
+}
+
+// add registers m for the sweeps
+func (c *Cleaner) add(m *SessionManager) {
+	select {
+	case c.register <- m:
+	case <-c.done:
+	}
+}
+
+// remove deregisters m. Once it returned no sweep of m is running nor
+// starts anymore, since the worker receives it in between sweeps.
+func (c *Cleaner) remove(m *SessionManager) {
+	select {
+	case c.deregister <- m:
+	case <-c.done:
+	}
+}
+
+// worker sweeps every registered manager on each tick until the
+// cleaner is closed. It owns the set of managers, so registering never
+// races with a sweep.
+func (c *Cleaner) worker() {
+	defer close(c.workerDone)
+
+	managers := make(map[*SessionManager]struct{})
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.register:
+			managers[m] = struct{}{}
+		case m := <-c.deregister:
+			delete(managers, m)
+		case now := <-c.ticker.C():
+			for m := range managers {
+				m.sweepForCleaner(now)
+			}
+		case req := <-c.prune:
+			if _, ok := managers[req.m]; !ok {
+				// Closed meanwhile
+				req.pruned <- 0
+				continue
+			}
+			req.m.pruneForCleaner(req.pruned)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "container/heap"
+
+// WithEvictionOrder makes WithMaxSessions and WithMemoryLimit evict the
+// session which is least by less instead of the least recently updated
+// one, e.g. guest sessions before premium ones. less sees the current
+// data of the sessions and must not change it. Sessions are kept in a
+// heap ordered by less, which costs O(log n) on every update.
+func WithEvictionOrder(less func(a, b Session) bool) Option {
+	return func(m *SessionManager) {
+		m.eviction = newEvictionHeap(m.sessions, less)
+	}
+}
+
+// leastRecentlyUpdated is the default eviction order
+func leastRecentlyUpdated(a, b Session) bool {
+	return a.updated < b.updated
+}
+
+func newEvictionHeap(sessions map[string]Session, less func(a, b Session) bool) *evictionHeap {
+	return &evictionHeap{
+		less:     less,
+		sessions: sessions,
+		index:    make(map[string]int),
+	}
+}
+
+// evictionHeap orders the sessionIDs of a manager by less, the least
+// session at the top. It is guarded by the manager's lock.
+type evictionHeap struct {
+	less     func(a, b Session) bool
+	sessions map[string]Session
+	ids      []string
+	index    map[string]int
+}
+
+func (h *evictionHeap) Len() int {
+	return len(h.ids)
+}
+
+func (h *evictionHeap) Less(i, j int) bool {
+	return h.less(h.sessions[h.ids[i]], h.sessions[h.ids[j]])
+}
+
+func (h *evictionHeap) Swap(i, j int) {
+	h.ids[i], h.ids[j] = h.ids[j], h.ids[i]
+	h.index[h.ids[i]] = i
+	h.index[h.ids[j]] = j
+}
+
+func (h *evictionHeap) Push(x interface{}) {
+	sessionID := x.(string)
+	h.index[sessionID] = len(h.ids)
+	h.ids = append(h.ids, sessionID)
+}
+
+func (h *evictionHeap) Pop() interface{} {
+	last := len(h.ids) - 1
+	sessionID := h.ids[last]
+	h.ids = h.ids[:last]
+	delete(h.index, sessionID)
+	return sessionID
+}
+
+// put adds the session or moves it according to its new data, it must
+// already be stored in sessions
+func (h *evictionHeap) put(sessionID string) {
+	if i, ok := h.index[sessionID]; ok {
+		heap.Fix(h, i)
+		return
+	}
+	heap.Push(h, sessionID)
+}
+
+// remove drops the session, unknown sessions are ignored
+func (h *evictionHeap) remove(sessionID string) {
+	if i, ok := h.index[sessionID]; ok {
+		heap.Remove(h, i)
+	}
+}
+
+// reset drops every session and follows the manager to its new map
+func (h *evictionHeap) reset(sessions map[string]Session) {
+	h.sessions = sessions
+	h.ids = nil
+	h.index = make(map[string]int)
+}
+
+// victim returns the least session other than keep. As keep is at most
+// the top, the least of its children is next.
+func (h *evictionHeap) victim(keep string) (string, bool) {
+	if len(h.ids) == 0 {
+		return "", false
+	}
+	if h.ids[0] != keep {
+		return h.ids[0], true
+	}
+
+	switch {
+	case len(h.ids) == 1:
+		return "", false
+	case len(h.ids) == 2 || h.Less(1, 2):
+		return h.ids[1], true
+	default:
+		return h.ids[2], true
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+// OverflowPolicy decides what happens to an expiration while the
+// Expirations channel is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the new expiration, it is the default
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered expiration to make
+	// room for the new one
+	OverflowDropOldest
+	// OverflowBlock waits until the consumer reads, so no expiration
+	// is lost. A stuck consumer stalls the expiration of all sessions
+	// though, as the worker waits for it.
+	OverflowBlock
+)
+
+// WithExpirationsOverflow makes the Expirations channel buffer
+// bufferSize ids and applies policy while it is full. An unbuffered
+// channel has no room to drop from, so a bufferSize of zero or less
+// always uses OverflowBlock.
+func WithExpirationsOverflow(bufferSize int, policy OverflowPolicy) Option {
+	return func(m *SessionManager) {
+		if bufferSize <= 0 {
+			bufferSize, policy = 0, OverflowBlock
+		}
+		m.expirations = make(chan string, bufferSize)
+		m.overflow = policy
+	}
+}
+
+// sendExpiration passes sessionID to the Expirations channel according
+// to the overflow policy. It does nothing once the channel is closed.
+func (m *SessionManager) sendExpiration(sessionID string) {
+	m.expirationsMu.RLock()
+	defer m.expirationsMu.RUnlock()
+
+	if m.expirationsClosed {
+		return
+	}
+
+	switch m.overflow {
+	case OverflowBlock:
+		select {
+		case m.expirations <- sessionID:
+		case <-m.done:
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case m.expirations <- sessionID:
+				return
+			case <-m.done:
+				return
+			default:
+			}
+			// The consumer may have read meanwhile, so never block here
+			select {
+			case <-m.expirations:
+			default:
+			}
+		}
+	default:
+		select {
+		case m.expirations <- sessionID:
+		default:
+			// Nobody keeps up with the channel, drop the event
+		}
+	}
+}
+
+// closeExpirations closes the Expirations channel once no send is in
+// progress. Blocked sends give up on done, so it must be closed before.
+func (m *SessionManager) closeExpirations() {
+	m.expirationsMu.Lock()
+	defer m.expirationsMu.Unlock()
+
+	m.expirationsClosed = true
+	close(m.expirations)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryEntry is the expiry of a single session
+type expiryEntry struct {
+	sessionID string
+	expireAt  time.Time
+}
+
+// expiryHeap orders the armed sessions of a manager by their expiry,
+// the soonest at the top. index maps every sessionID to its position,
+// so re-arming and removing a session costs O(log n). It is guarded by
+// the manager's lock.
+type expiryHeap struct {
+	entries []expiryEntry
+	index   map[string]int
+}
+
+func newExpiryHeap() *expiryHeap {
+	return &expiryHeap{index: make(map[string]int)}
+}
+
+func (h *expiryHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *expiryHeap) Less(i, j int) bool {
+	return h.entries[i].expireAt.Before(h.entries[j].expireAt)
+}
+
+func (h *expiryHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.index[h.entries[i].sessionID] = i
+	h.index[h.entries[j].sessionID] = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(expiryEntry)
+	h.index[entry.sessionID] = len(h.entries)
+	h.entries = append(h.entries, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	last := len(h.entries) - 1
+	entry := h.entries[last]
+	h.entries = h.entries[:last]
+	delete(h.index, entry.sessionID)
+	return entry
+}
+
+// set arms the session to expire at expireAt, replacing its previous
+// expiry
+func (h *expiryHeap) set(sessionID string, expireAt time.Time) {
+	if i, ok := h.index[sessionID]; ok {
+		h.entries[i].expireAt = expireAt
+		heap.Fix(h, i)
+		return
+	}
+	heap.Push(h, expiryEntry{sessionID: sessionID, expireAt: expireAt})
+}
+
+// remove disarms the session, unknown sessions are ignored
+func (h *expiryHeap) remove(sessionID string) {
+	if i, ok := h.index[sessionID]; ok {
+		heap.Remove(h, i)
+	}
+}
+
+// get returns when the session expires and whether it is armed
+func (h *expiryHeap) get(sessionID string) (time.Time, bool) {
+	i, ok := h.index[sessionID]
+	if !ok {
+		return time.Time{}, false
+	}
+	return h.entries[i].expireAt, true
+}
+
+// popExpired removes and returns the sessionIDs of all sessions which
+// expired before now, a session expiring exactly at now is kept
+func (h *expiryHeap) popExpired(now time.Time) []string {
+	var sessionIDs []string
+	for len(h.entries) > 0 && h.entries[0].expireAt.Before(now) {
+		sessionIDs = append(sessionIDs, heap.Pop(h).(expiryEntry).sessionID)
+	}
+	return sessionIDs
+}
+
+// reset disarms every session
+func (h *expiryHeap) reset() {
+	h.entries = nil
+	h.index = make(map[string]int)
+}
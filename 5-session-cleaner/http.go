@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// SessionCookieName is the cookie Middleware keeps the sessionID in
+const SessionCookieName = "session_id"
+
+// sessionIDKey is the request context key of the sessionID
+type sessionIDKey struct{}
+
+// Middleware returns net/http middleware which loads the session named
+// by the session cookie and renews its expiry on every request. Requests
+// without a known session get a new one, whose sessionID is sent back
+// in the cookie. Unknown sessionIDs from clients are never adopted.
+// Handlers retrieve the sessionID with SessionFromContext.
+func Middleware(m *SessionManager) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var sessionID string
+			if cookie, err := r.Cookie(SessionCookieName); err == nil && m.Touch(cookie.Value) == nil {
+				sessionID = cookie.Value
+			} else {
+				sessionID, err = m.CreateSession()
+				if err == ErrManagerClosed {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     SessionCookieName,
+					Value:    sessionID,
+					Path:     "/",
+					HttpOnly: true,
+				})
+			}
+
+			ctx := context.WithValue(r.Context(), sessionIDKey{}, sessionID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// SessionFromContext returns the sessionID Middleware stored in the
+// context of r
+func SessionFromContext(r *http.Request) (string, bool) {
+	sessionID, ok := r.Context().Value(sessionIDKey{}).(string)
+	return sessionID, ok
+}
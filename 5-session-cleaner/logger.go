@@ -0,0 +1,13 @@
+package main
+
+// Logger receives the lifecycle messages of a SessionManager, a
+// *log.Logger satisfies it. Printf may be called while the manager's
+// lock is held, so it must not call back into the manager.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// nopLogger discards every message, it is the default Logger
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
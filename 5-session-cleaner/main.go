@@ -18,51 +18,941 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultTTL is how long a session is kept after its last update
+	defaultTTL = 5 * time.Second
+	// maxExpirationCheckInterval caps how often the worker looks for
+	// expired sessions, so long TTLs still get evicted promptly
+	maxExpirationCheckInterval = 1 * time.Second
+	// sessionIDAttempts is how often a colliding sessionID is
+	// generated again before CreateSession gives up
+	sessionIDAttempts = 3
+	// expirationsBufferSize is how many expired sessionIDs the
+	// Expirations channel holds before dropping new ones
+	expirationsBufferSize = 100
 )
 
 // SessionManager keeps track of all sessions from creation, updating
 // to destroying.
 type SessionManager struct {
-	sessions map[string]Session
+	mu                      sync.RWMutex
+	sessions                map[string]Session
+	expiries                *expiryHeap
+	expirationCheckInterval time.Duration
+	expirationCheckTicker   Ticker
+	clock                   Clock
+	logger                  Logger
+	ttl                     time.Duration
+	maxLifetime             time.Duration
+	jitter                  time.Duration
+	maxSessions             int
+	highWater               int
+	lowWater                int
+	overloaded              bool
+	eviction                *evictionHeap
+	updates                 uint64
+	maxBytes                int64
+	sizeOf                  func(Session) int64
+	totalBytes              int64
+	emptied                 chan struct{}
+	makeSessionID           func() (string, error)
+	limiter                 *rateLimiter
+	cleaner                 *Cleaner
+	lazyExpiry              bool
+	onExpire                ExpireFunc
+	onCreate                SessionFunc
+	onUpdate                SessionFunc
+	expirations             chan string
+	overflow                OverflowPolicy
+	stats                   counters
+
+	closed     bool
+	closeOnce  sync.Once
+	done       chan struct{}
+	workerDone chan struct{}
+	// prune asks the worker for a sweep, which replies with the number
+	// of removed sessions
+	prune chan chan int
+	// lastSweep is the UnixNano time of the last completed sweep
+	lastSweep atomic.Int64
+	// expirationsMu guards closing the expirations channel against
+	// sends, which hold it for reading
+	expirationsMu     sync.RWMutex
+	expirationsClosed bool
+	// tagIndex maps tag keys and values to the sessions tagged so
+	tagIndex map[string]map[string]map[string]struct{}
+	// lazilyExpired holds the sessions removed by lazy expiry until the
+	// worker notifies about them, lazyNotify wakes it up
+	lazilyExpired map[string]Session
+	lazyNotify    chan struct{}
 }
 
+// Stats holds the cumulative counters of a SessionManager. Every
+// session gets in by being created or loaded and out by expiring, being
+// deleted or evicted, so CreatedTotal + LoadedTotal - ExpiredTotal -
+// DeletedTotal - EvictedTotal is CurrentActive.
+type Stats struct {
+	CreatedTotal  int64
+	LoadedTotal   int64
+	ExpiredTotal  int64
+	DeletedTotal  int64
+	EvictedTotal  int64
+	CurrentActive int64
+}
+
+// counters backs Stats, they are updated under the write lock but read
+// without it
+type counters struct {
+	created atomic.Int64
+	loaded  atomic.Int64
+	expired atomic.Int64
+	deleted atomic.Int64
+	evicted atomic.Int64
+	active  atomic.Int64
+}
+
+// ExpireFunc is called with the data of a session removed by the
+// expiration worker
+type ExpireFunc func(sessionID string, data map[string]interface{})
+
+// SessionFunc is called with the sessionID of a created or updated
+// session
+type SessionFunc func(sessionID string)
+
 // Session stores the session's data
 type Session struct {
 	Data map[string]interface{}
+
+	// ttl is how long the session lives after its last update
+	ttl time.Duration
+	// size is the estimated size of the session when it was stored
+	size int64
+	// version counts how often the session data was stored
+	version uint64
+	// expireAt is the expiry of the session when it was snapshotted
+	expireAt time.Time
+	// deadline ends the session no matter how often it is renewed, zero
+	// means the session lives as long as it gets renewed
+	deadline time.Time
+	// tags are set on creation and never change
+	tags map[string]string
+	// updated orders the sessions by their last update for eviction
+	updated uint64
+}
+
+// Option configures a SessionManager on creation
+type Option func(*SessionManager)
+
+// WithClock replaces the real time used for expiration, e.g. with a
+// fake clock in tests
+func WithClock(clock Clock) Option {
+	return func(m *SessionManager) {
+		m.clock = clock
+	}
+}
+
+// WithLogger routes the manager's lifecycle messages to logger instead
+// of discarding them
+func WithLogger(logger Logger) Option {
+	return func(m *SessionManager) {
+		m.logger = logger
+	}
+}
+
+// WithMaxSessions limits the number of sessions kept at once. Creating
+// a session beyond the limit evicts the least recently updated or
+// touched one, no matter when it expires. A limit of zero or less
+// means no limit.
+func WithMaxSessions(n int) Option {
+	return func(m *SessionManager) {
+		m.maxSessions = n
+	}
+}
+
+// WithBackpressure makes creating sessions fail with
+// ErrManagerOverloaded once highWater sessions are kept, e.g. when they
+// are created faster than they expire. Creating sessions works again
+// once no more than lowWater sessions are left, so the manager does
+// not flap around a single limit. lowWater must be below highWater.
+func WithBackpressure(highWater, lowWater int) Option {
+	return func(m *SessionManager) {
+		m.highWater = highWater
+		m.lowWater = lowWater
+	}
+}
+
+// WithMemoryLimit limits the estimated memory kept by all sessions
+// together. sizeOf estimates the bytes of a single session. Creating or
+// updating a session beyond the limit evicts the least recently
+// updated sessions until the total fits again, a single session larger
+// than maxBytes is kept on its own though. A limit of zero or less
+// means no limit.
+func WithMemoryLimit(maxBytes int64, sizeOf func(Session) int64) Option {
+	return func(m *SessionManager) {
+		m.maxBytes = maxBytes
+		m.sizeOf = sizeOf
+	}
+}
+
+// WithExpirationJitter moves the expiry of every session by a random
+// offset of up to jitter in either direction, so sessions created at
+// the same time do not all expire in the same check. Sessions then
+// expire ttl ± jitter after their last update. A jitter of zero or less
+// means no jitter.
+func WithExpirationJitter(jitter time.Duration) Option {
+	return func(m *SessionManager) {
+		m.jitter = jitter
+	}
+}
+
+// WithExpirationCheckInterval sets how often the worker looks for
+// expired sessions instead of deriving it from the ttl. Sessions get
+// removed at most one interval after they expired, i.e. between ttl and
+// ttl plus one interval after their last update, so a shorter interval
+// tightens that window at the cost of more frequent checks. The interval must be positive.
+func WithExpirationCheckInterval(interval time.Duration) Option {
+	return func(m *SessionManager) {
+		m.expirationCheckInterval = interval
+	}
+}
+
+// WithLazyExpiry makes lookups and updates check the session's expiry
+// themselves, so a session is never found, returned or renewed once it
+// expired, even if the worker did not remove it yet. The expired
+// session is removed right away then, but OnExpire and the Expirations
+// channel are still served by the worker, or by the next sweep of the
+// Cleaner, so a lookup never blocks on them. GetSessionDataUnsafe,
+// GetSessionsData, ForEachSession and Snapshot do not check it.
+func WithLazyExpiry() Option {
+	return func(m *SessionManager) {
+		m.lazyExpiry = true
+	}
+}
+
+// WithSessionIDGenerator replaces MakeSessionID for minting the IDs
+// of new sessions
+func WithSessionIDGenerator(generate func() (string, error)) Option {
+	return func(m *SessionManager) {
+		m.makeSessionID = generate
+	}
 }
 
 // NewSessionManager creates a new sessionManager
-func NewSessionManager() *SessionManager {
+func NewSessionManager(opts ...Option) *SessionManager {
+	return NewSessionManagerWithTTL(defaultTTL, opts...)
+}
+
+// NewSessionManagerWithTTL creates a new sessionManager whose sessions
+// expire ttl after their last update. The ttl must be positive.
+func NewSessionManagerWithTTL(ttl time.Duration, opts ...Option) *SessionManager {
 	m := &SessionManager{
-		sessions: make(map[string]Session),
+		sessions:                make(map[string]Session),
+		expiries:                newExpiryHeap(),
+		expirationCheckInterval: expirationCheckIntervalFor(ttl),
+		clock:                   realClock{},
+		logger:                  nopLogger{},
+		makeSessionID:           MakeSessionID,
+		expirations:             make(chan string, expirationsBufferSize),
+		ttl:                     ttl,
+		done:                    make(chan struct{}),
+		workerDone:              make(chan struct{}),
+		prune:                   make(chan chan int),
+		lazyNotify:              make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	if m.eviction == nil && (m.maxSessions > 0 || m.maxBytes > 0) {
+		m.eviction = newEvictionHeap(m.sessions, leastRecentlyUpdated)
+	}
+	if m.cleaner != nil {
+		m.cleaner.add(m)
+		return m
+	}
+	m.expirationCheckTicker = m.clock.NewTicker(m.expirationCheckInterval)
+
+	go m.removeExpiredSessionsWorker()
 
 	return m
 }
 
+// NewSessionManagerWithLifetime creates a new sessionManager whose
+// sessions expire idleTimeout after their last update or maxLifetime
+// after their creation, whichever comes first. Both must be positive.
+func NewSessionManagerWithLifetime(idleTimeout, maxLifetime time.Duration, opts ...Option) *SessionManager {
+	setLifetime := func(m *SessionManager) {
+		m.maxLifetime = maxLifetime
+	}
+	return NewSessionManagerWithTTL(idleTimeout, append([]Option{setLifetime}, opts...)...)
+}
+
+// expirationCheckIntervalFor derives the worker interval from the
+// ttl. A fifth of the ttl keeps the default 5s ttl at one check per
+// second, which removes sessions between 5 and 6 seconds.
+func expirationCheckIntervalFor(ttl time.Duration) time.Duration {
+	interval := ttl / 5
+	if interval > maxExpirationCheckInterval {
+		return maxExpirationCheckInterval
+	}
+	if interval < time.Millisecond {
+		return time.Millisecond
+	}
+	return interval
+}
+
+// ErrManagerClosed returned when the SessionManager is used after
+// Close has been called
+var ErrManagerClosed = errors.New("SessionManager is closed")
+
+// Close stops the background worker and waits for it to return.
+// After Close, CreateSession and UpdateSessionData return
+// ErrManagerClosed. Calling Close more than once is a no-op. As it
+// waits for the worker, or the Cleaner, Close must not be called from
+// an OnExpire callback, which runs on it, other than in a goroutine of
+// its own, e.g. go m.Close().
+func (m *SessionManager) Close() {
+	m.closeOnce.Do(func() {
+		m.mu.Lock()
+		m.closed = true
+		m.mu.Unlock()
+
+		if m.cleaner != nil {
+			// Closed first, so a sweep blocked on a full Expirations
+			// channel lets the cleaner go
+			close(m.done)
+			m.cleaner.remove(m)
+			m.notifyLazilyExpired()
+			m.closeExpirations()
+		} else {
+			m.expirationCheckTicker.Stop()
+			close(m.done)
+			<-m.workerDone
+		}
+		m.logger.Printf("SessionManager closed")
+	})
+}
+
+// OnExpire registers fn to be called for every session removed because
+// it expired. Callbacks run on the worker goroutine, or the Cleaner's,
+// right after the session got removed and outside of the manager's
+// lock, so they may call back into the manager, except for calling
+// Close directly, which would deadlock. Sessions removed by lazy expiry
+// are passed on the worker's next turn, or by Close if it comes first.
+// Callbacks should not block for long though, as they delay the next
+// expiration check.
+func (m *SessionManager) OnExpire(fn ExpireFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onExpire = fn
+}
+
+// OnCreate registers fn to be called for every created session, e.g.
+// for audit logging. Callbacks run on the creating goroutine once the
+// manager's lock is released, so they may call back into the manager.
+func (m *SessionManager) OnCreate(fn SessionFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onCreate = fn
+}
+
+// OnUpdate registers fn to be called for every session whose data got
+// updated. Like OnCreate callbacks, they run on the updating goroutine
+// outside of the manager's lock. Touch does not count as an update.
+func (m *SessionManager) OnUpdate(fn SessionFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.onUpdate = fn
+}
+
+// notifyCreated calls the OnCreate callback if there is one, the
+// caller must not hold the lock
+func (m *SessionManager) notifyCreated(sessionID string) {
+	m.mu.RLock()
+	onCreate := m.onCreate
+	m.mu.RUnlock()
+
+	if onCreate != nil {
+		onCreate(sessionID)
+	}
+}
+
+// notifyUpdated calls the OnUpdate callback if there is one, the
+// caller must not hold the lock
+func (m *SessionManager) notifyUpdated(sessionID string) {
+	m.mu.RLock()
+	onUpdate := m.onUpdate
+	m.mu.RUnlock()
+
+	if onUpdate != nil {
+		onUpdate(sessionID)
+	}
+}
+
+// Expirations returns a channel receiving the sessionID of every
+// session the worker removes because it expired. The channel buffers
+// expirationsBufferSize ids, new expirations are dropped while it is
+// full unless configured otherwise by WithExpirationsOverflow. It is
+// closed once the manager is closed.
+func (m *SessionManager) Expirations() <-chan string {
+	return m.expirations
+}
+
+// Prune removes every session which expired before now without
+// waiting for the next check and returns how many. The sweep runs on
+// the worker goroutine like the periodic ones, so Prune must not be
+// called from an OnExpire callback. After Close it removes nothing and
+// returns 0.
+func (m *SessionManager) Prune() int {
+	// Buffered, so a panicking sweep can reply without blocking
+	pruned := make(chan int, 1)
+	if m.cleaner != nil {
+		select {
+		case m.cleaner.prune <- pruneRequest{m: m, pruned: pruned}:
+			return <-pruned
+		case <-m.done:
+			return 0
+		case <-m.cleaner.done:
+			return 0
+		}
+	}
+
+	select {
+	case m.prune <- pruned:
+		return <-pruned
+	case <-m.done:
+		return 0
+	}
+}
+
+// removeExpiredSessionsWorker removes expired sessions on every tick
+// until the manager is closed. A panicking sweep, e.g. in an OnExpire
+// callback, is logged and the worker keeps going with the next tick,
+// so sessions never silently stop expiring.
+func (m *SessionManager) removeExpiredSessionsWorker() {
+	defer close(m.workerDone)
+	defer m.closeExpirations()
+
+	for !m.runSweeps() {
+	}
+	m.notifyLazilyExpired()
+}
+
+// runSweeps removes expired sessions on every tick. It returns true
+// once the manager is closed and false if a sweep panicked.
+func (m *SessionManager) runSweeps() (closed bool) {
+	defer m.recoverSweep()
+
+	for {
+		select {
+		case <-m.done:
+			return true
+		case now := <-m.expirationCheckTicker.C():
+			m.removeExpiredSessions(now)
+		case pruned := <-m.prune:
+			m.prunePanicSafe(pruned)
+		case <-m.lazyNotify:
+			m.notifyLazilyExpired()
+		}
+	}
+}
+
+// recoverSweep logs a panicking sweep, it must be deferred directly
+func (m *SessionManager) recoverSweep() {
+	if r := recover(); r != nil {
+		m.logger.Printf("Expiration sweep panicked: %v", r)
+	}
+}
+
+// sweepForCleaner removes the sessions which expired before now for a
+// Cleaner, a panic is logged rather than stopping the cleaner
+func (m *SessionManager) sweepForCleaner(now time.Time) {
+	defer m.recoverSweep()
+	m.removeExpiredSessions(now)
+}
+
+// pruneForCleaner is sweepForCleaner for Prune, it replies on pruned
+// even if the sweep panics
+func (m *SessionManager) pruneForCleaner(pruned chan<- int) {
+	defer m.recoverSweep()
+	m.prunePanicSafe(pruned)
+}
+
+// prunePanicSafe runs a sweep for Prune and replies on pruned even if
+// the sweep panics, so Prune never waits forever
+func (m *SessionManager) prunePanicSafe(pruned chan<- int) {
+	n := 0
+	defer func() {
+		pruned <- n
+	}()
+	n = m.removeExpiredSessions(m.clock.Now())
+}
+
+// LastSweepTime returns when the worker last completed looking for
+// expired sessions, or the zero time if it never did. A LastSweepTime
+// lagging far behind the expiration check interval means sessions are
+// no longer expiring.
+func (m *SessionManager) LastSweepTime() time.Time {
+	lastSweep := m.lastSweep.Load()
+	if lastSweep == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastSweep)
+}
+
+// removeExpiredSessions deletes every session which expired before
+// now and returns how many. Only the expired sessions are visited, so
+// a delayed worker catches up on everything it missed at once.
+func (m *SessionManager) removeExpiredSessions(now time.Time) int {
+	m.mu.Lock()
+	onExpire := m.onExpire
+	sessionIDs := m.expiries.popExpired(now)
+	// Notify about the lazily expired sessions as well, a Cleaner has
+	// no other chance to
+	expired := m.lazilyExpired
+	m.lazilyExpired = nil
+	if expired == nil {
+		expired = make(map[string]Session, len(sessionIDs))
+	}
+
+	for _, sessionID := range sessionIDs {
+		expired[sessionID] = m.sessions[sessionID]
+		m.removeExpiredSession(sessionID)
+	}
+	m.mu.Unlock()
+
+	m.notifyExpired(onExpire, expired)
+	m.lastSweep.Store(now.UnixNano())
+	return len(sessionIDs)
+}
+
+// expireSession removes the session if it expired before now, e.g.
+// when it is read before the worker got to it
+func (m *SessionManager) expireSession(sessionID string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.sessions[sessionID]
+	// It may have been renewed or removed since it was read
+	if expireAt, _ := m.expiries.get(sessionID); !ok || !expireAt.Before(now) {
+		return
+	}
+	m.removeLazilyExpired(sessionID)
+}
+
+// removeLazilyExpired deletes the session as expired and leaves the
+// notifications to the worker, so the caller never runs OnExpire nor
+// blocks on the Expirations channel. The caller must hold the write
+// lock.
+func (m *SessionManager) removeLazilyExpired(sessionID string) {
+	if m.lazilyExpired == nil {
+		m.lazilyExpired = make(map[string]Session)
+	}
+	m.lazilyExpired[sessionID] = m.sessions[sessionID]
+	m.removeExpiredSession(sessionID)
+
+	select {
+	case m.lazyNotify <- struct{}{}:
+	default:
+		// The worker is woken up already
+	}
+}
+
+// notifyLazilyExpired notifies about the sessions removed by lazy
+// expiry so far
+func (m *SessionManager) notifyLazilyExpired() {
+	m.mu.Lock()
+	onExpire := m.onExpire
+	expired := m.lazilyExpired
+	m.lazilyExpired = nil
+	m.mu.Unlock()
+
+	m.notifyExpired(onExpire, expired)
+}
+
+// liveSession returns the session unless it is unknown or, with lazy
+// expiry, expired before now. expired reports the latter, the caller
+// then removes the session with expireSession once it released the
+// lock. The caller must hold the lock.
+func (m *SessionManager) liveSession(sessionID string, now time.Time) (session Session, ok, expired bool) {
+	session, ok = m.sessions[sessionID]
+	if !ok || !m.lazyExpiry {
+		return session, ok, false
+	}
+	if expireAt, _ := m.expiries.get(sessionID); expireAt.Before(now) {
+		return Session{}, false, true
+	}
+	return session, true, false
+}
+
+// removeExpiredSession deletes the session as expired, the caller must
+// hold the write lock
+func (m *SessionManager) removeExpiredSession(sessionID string) {
+	m.deleteSession(sessionID)
+	m.stats.expired.Add(1)
+	m.stats.active.Add(-1)
+	m.removeSessionExpiration(sessionID)
+}
+
+// notifyExpired logs the expired sessions and passes them to onExpire
+// and the Expirations channel. Callbacks run without the lock, so they
+// may use the manager.
+func (m *SessionManager) notifyExpired(onExpire ExpireFunc, expired map[string]Session) {
+	for sessionID, session := range expired {
+		m.logger.Printf("Session %s expired", sessionID)
+		if onExpire != nil {
+			onExpire(sessionID, session.Data)
+		}
+		m.sendExpiration(sessionID)
+	}
+}
+
+// updateSessionExpiration renews the expiry of the session, but never
+// beyond its deadline. The caller must hold the write lock.
+func (m *SessionManager) updateSessionExpiration(sessionID string) {
+	session := m.sessions[sessionID]
+	ttl := session.ttl
+	if m.jitter > 0 {
+		ttl += time.Duration(rand.Int63n(2*int64(m.jitter)+1)) - m.jitter
+	}
+
+	expireAt := m.clock.Now().Add(ttl)
+	if !session.deadline.IsZero() && session.deadline.Before(expireAt) {
+		expireAt = session.deadline
+	}
+	m.setSessionExpiration(sessionID, expireAt)
+}
+
+// setSessionExpiration arms the session to expire at expireAt,
+// replacing its previous expiry. The caller must hold the write lock.
+func (m *SessionManager) setSessionExpiration(sessionID string, expireAt time.Time) {
+	m.expiries.set(sessionID, expireAt)
+}
+
+// removeSessionExpiration disarms the session's expiry, the caller
+// must hold the write lock
+func (m *SessionManager) removeSessionExpiration(sessionID string) {
+	m.expiries.remove(sessionID)
+}
+
+// evictOldestSession removes the least recently updated session, or
+// the least one by the eviction order, other than keep. It reports
+// whether there was one to remove. The caller must hold the write
+// lock.
+func (m *SessionManager) evictOldestSession(keep string) bool {
+	if m.eviction == nil {
+		return false
+	}
+	victim, ok := m.eviction.victim(keep)
+	if !ok {
+		return false
+	}
+
+	m.deleteSession(victim)
+	m.stats.evicted.Add(1)
+	m.stats.active.Add(-1)
+	m.removeSessionExpiration(victim)
+	m.logger.Printf("Session %s evicted", victim)
+	return true
+}
+
+// evictOverMemoryLimit evicts the least recently updated sessions
+// while the estimated total exceeds the memory limit, but always keeps
+// the last session and keep, the session just stored. With an eviction
+// order keep is not necessarily the greatest, so it is skipped
+// explicitly. The caller must hold the write lock.
+func (m *SessionManager) evictOverMemoryLimit(keep string) {
+	for m.maxBytes > 0 && m.totalBytes > m.maxBytes && len(m.sessions) > 1 {
+		if !m.evictOldestSession(keep) {
+			return
+		}
+	}
+}
+
+// putSession stores the session, accounts for its estimated size,
+// indexes its tags and bumps its version. The caller must hold the
+// write lock.
+func (m *SessionManager) putSession(sessionID string, session Session) {
+	session.version = 1
+	if old, ok := m.sessions[sessionID]; ok {
+		m.totalBytes -= old.size
+		session.version = old.version + 1
+		m.unindexTags(sessionID, old.tags)
+	}
+	m.indexTags(sessionID, session.tags)
+	session.size = 0
+	if m.sizeOf != nil {
+		session.size = m.sizeOf(session)
+	}
+	m.totalBytes += session.size
+	m.updates++
+	session.updated = m.updates
+	m.sessions[sessionID] = session
+	if m.eviction != nil {
+		m.eviction.put(sessionID)
+	}
+}
+
+// touchSession marks the session as the most recently updated one
+// without storing it again, the caller must hold the write lock
+func (m *SessionManager) touchSession(sessionID string) {
+	session := m.sessions[sessionID]
+	m.updates++
+	session.updated = m.updates
+	m.sessions[sessionID] = session
+	if m.eviction != nil {
+		m.eviction.put(sessionID)
+	}
+}
+
+// deleteSession removes the session and its estimated size, the caller
+// must hold the write lock
+func (m *SessionManager) deleteSession(sessionID string) {
+	m.totalBytes -= m.sessions[sessionID].size
+	m.unindexTags(sessionID, m.sessions[sessionID].tags)
+	if m.eviction != nil {
+		m.eviction.remove(sessionID)
+	}
+	delete(m.sessions, sessionID)
+
+	// Wake up everyone waiting in WaitUntilEmpty
+	if len(m.sessions) == 0 && m.emptied != nil {
+		close(m.emptied)
+		m.emptied = nil
+	}
+}
+
 // CreateSession creates a new session and returns the sessionID
 func (m *SessionManager) CreateSession() (string, error) {
-	sessionID, err := MakeSessionID()
+	return m.CreateSessionWithTTL(m.ttl)
+}
+
+// CreateSessionWithTTL creates a new session which expires ttl after
+// its last update instead of the manager-wide ttl. Sessions are still
+// checked on the manager's interval, so a ttl much shorter than the
+// manager's gets evicted less precisely.
+func (m *SessionManager) CreateSessionWithTTL(ttl time.Duration) (string, error) {
+	return m.createSession(Session{Data: make(map[string]interface{}), ttl: ttl})
+}
+
+// CreateSessionWithData creates a new session holding a copy of data
+// and returns the sessionID, a nil map is stored as an empty one.
+// Unlike CreateSession followed by UpdateSessionData, the session is
+// never visible without its data.
+func (m *SessionManager) CreateSessionWithData(data map[string]interface{}) (string, error) {
+	return m.createSession(Session{Data: copyData(data), ttl: m.ttl})
+}
+
+// createSession stores session as a new one and returns the sessionID
+func (m *SessionManager) createSession(session Session) (sessionID string, err error) {
+	// Deferred first, so it runs once the lock is released
+	defer func() {
+		if err == nil {
+			m.notifyCreated(sessionID)
+		}
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.createSessionLocked(session)
+}
+
+// TryCreateSession is like CreateSession but rather than waiting for
+// the manager's lock under contention it returns ok false right away
+// without creating a session. Readers hold the lock as well, so it
+// fails more often than it would need to block, and retrying it in a
+// loop just burns CPU, use CreateSession when waiting is acceptable.
+func (m *SessionManager) TryCreateSession() (sessionID string, ok bool, err error) {
+	if !m.mu.TryLock() {
+		return "", false, nil
+	}
+	sessionID, err = m.createSessionLocked(Session{Data: make(map[string]interface{}), ttl: m.ttl})
+	m.mu.Unlock()
+
 	if err != nil {
+		return "", true, err
+	}
+	m.notifyCreated(sessionID)
+	return sessionID, true, nil
+}
+
+// createSessionLocked is createSession for a caller holding the write
+// lock
+func (m *SessionManager) createSessionLocked(session Session) (string, error) {
+	if m.closed {
+		return "", ErrManagerClosed
+	}
+	if err := m.admitSession(); err != nil {
 		return "", err
 	}
 
-	m.sessions[sessionID] = Session{
-		Data: make(map[string]interface{}),
+	sessionID, err := m.newSessionID()
+	if err != nil {
+		return "", err
 	}
+	m.addSession(sessionID, session)
 
 	return sessionID, nil
 }
 
+// addSession stores session as a new one under sessionID and arms its
+// expiry, evicting older sessions when over the limits. The caller
+// must hold the write lock.
+func (m *SessionManager) addSession(sessionID string, session Session) {
+	if m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+		m.evictOldestSession("")
+	}
+
+	if m.maxLifetime > 0 {
+		session.deadline = m.clock.Now().Add(m.maxLifetime)
+	}
+	m.putSession(sessionID, session)
+	m.updateSessionExpiration(sessionID)
+	m.stats.created.Add(1)
+	m.stats.active.Add(1)
+	m.logger.Printf("Session %s created", sessionID)
+	m.evictOverMemoryLimit(sessionID)
+}
+
+// GetOrCreateSession returns a copy of the data of the session with
+// the given sessionID, creating an empty session under that id first
+// if there is none. The returned bool reports whether the session was
+// created. Lookup and creation happen under the same lock, so
+// concurrent calls for the same id create it only once.
+func (m *SessionManager) GetOrCreateSession(sessionID string) (data map[string]interface{}, created bool, err error) {
+	defer func() {
+		if created {
+			m.notifyCreated(sessionID)
+		}
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, false, ErrManagerClosed
+	}
+
+	session, ok, lazilyExpired := m.liveSession(sessionID, m.clock.Now())
+	if ok {
+		return copyData(session.Data), false, nil
+	}
+	// It is replaced by a new session right away under the same lock
+	if lazilyExpired {
+		m.removeLazilyExpired(sessionID)
+	}
+	if err := m.admitSession(); err != nil {
+		return nil, false, err
+	}
+	m.addSession(sessionID, Session{Data: make(map[string]interface{}), ttl: m.ttl})
+
+	return make(map[string]interface{}), true, nil
+}
+
+// ErrManagerOverloaded returned when sessions cannot be created until
+// enough of them expired, see WithBackpressure
+var ErrManagerOverloaded = errors.New("SessionManager is overloaded")
+
+// admitSession returns ErrManagerOverloaded if backpressure does not
+// allow to add a session right now. The caller must hold the write
+// lock.
+func (m *SessionManager) admitSession() error {
+	if m.highWater <= 0 {
+		return nil
+	}
+
+	if m.overloaded && len(m.sessions) <= m.lowWater {
+		m.overloaded = false
+	}
+	if !m.overloaded && len(m.sessions) >= m.highWater {
+		m.overloaded = true
+		m.logger.Printf("SessionManager overloaded with %d sessions", len(m.sessions))
+	}
+	if m.overloaded {
+		return ErrManagerOverloaded
+	}
+	return nil
+}
+
+// ErrSessionIDCollision returned when every generated sessionID is
+// already in use
+var ErrSessionIDCollision = errors.New("SessionID already exists")
+
+// newSessionID mints a sessionID which is not in use yet, retrying up
+// to sessionIDAttempts times on collisions. The caller must hold the
+// write lock.
+func (m *SessionManager) newSessionID() (string, error) {
+	for attempt := 0; attempt < sessionIDAttempts; attempt++ {
+		sessionID, err := m.makeSessionID()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := m.sessions[sessionID]; !ok {
+			return sessionID, nil
+		}
+	}
+	return "", ErrSessionIDCollision
+}
+
 // ErrSessionNotFound returned when sessionID not listed in
 // SessionManager
 var ErrSessionNotFound = errors.New("SessionID does not exists")
 
-// GetSessionData returns data related to session if sessionID is
-// found, errors otherwise
+// GetSessionData returns a copy of the data related to session if
+// sessionID is found, errors otherwise. The returned map is safe to
+// read and modify without further locking.
 func (m *SessionManager) GetSessionData(sessionID string) (map[string]interface{}, error) {
+	return m.GetSessionDataContext(context.Background(), sessionID)
+}
+
+// GetSessionDataContext is like GetSessionData but returns ctx.Err()
+// if the context is done before the session is looked up
+func (m *SessionManager) GetSessionDataContext(ctx context.Context, sessionID string) (map[string]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := m.clock.Now()
+
+	m.mu.RLock()
+	session, ok, expired := m.liveSession(sessionID, now)
+	if ok {
+		data := copyData(session.Data)
+		m.mu.RUnlock()
+		return data, nil
+	}
+	m.mu.RUnlock()
+
+	if expired {
+		m.expireSession(sessionID, now)
+	}
+	return nil, ErrSessionNotFound
+}
+
+// GetSessionDataUnsafe is like GetSessionData but returns the map
+// stored in the manager instead of a copy, to save the copy on hot read
+// paths. ONLY USE IT IF YOU NEVER MUTATE THE RETURNED MAP, not even
+// after the session got deleted, as any write races with every other
+// user of the session. Updates with UpdateSessionField and
+// UpdateSessionDataFunc change this very map in place, so reading it
+// is only safe while the session is not updated with them either. Lazy
+// expiry is not applied. When in doubt use GetSessionData.
+func (m *SessionManager) GetSessionDataUnsafe(sessionID string) (map[string]interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	session, ok := m.sessions[sessionID]
 	if !ok {
 		return nil, ErrSessionNotFound
@@ -70,24 +960,389 @@ func (m *SessionManager) GetSessionData(sessionID string) (map[string]interface{
 	return session.Data, nil
 }
 
-// UpdateSessionData overwrites the old session data with the new one
+// GetSessionsData returns a copy of the data of every found session
+// keyed by sessionID, looking them all up under a single lock. Unknown
+// sessionIDs are omitted from the result rather than reported as an
+// error.
+func (m *SessionManager) GetSessionsData(sessionIDs []string) (map[string]map[string]interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make(map[string]map[string]interface{}, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		if session, ok := m.sessions[sessionID]; ok {
+			result[sessionID] = copyData(session.Data)
+		}
+	}
+	return result, nil
+}
+
+// GetSessionExpiry returns when the session is going to expire unless
+// it gets renewed before
+func (m *SessionManager) GetSessionExpiry(sessionID string) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	expireAt, ok := m.expiries.get(sessionID)
+	if !ok {
+		return time.Time{}, ErrSessionNotFound
+	}
+	return expireAt, nil
+}
+
+// SessionsExpiringWithin returns the sessionIDs of all sessions which
+// are going to expire within d from now unless they get renewed, e.g.
+// to warn their users ahead. The order of the sessionIDs is undefined.
+func (m *SessionManager) SessionsExpiringWithin(d time.Duration) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deadline := m.clock.Now().Add(d)
+	var sessionIDs []string
+	for _, entry := range m.expiries.entries {
+		if entry.expireAt.Before(deadline) {
+			sessionIDs = append(sessionIDs, entry.sessionID)
+		}
+	}
+	return sessionIDs
+}
+
+// ForEachSession calls fn with a copy of the data of every session
+// until fn returns false. The sessions are copied under the lock
+// before the first call, so fn may safely call back into the manager,
+// but it does not see changes made during the iteration.
+func (m *SessionManager) ForEachSession(fn func(sessionID string, data map[string]interface{}) bool) {
+	m.mu.RLock()
+	sessions := make(map[string]map[string]interface{}, len(m.sessions))
+	for sessionID, session := range m.sessions {
+		sessions[sessionID] = copyData(session.Data)
+	}
+	m.mu.RUnlock()
+
+	for sessionID, data := range sessions {
+		if !fn(sessionID, data) {
+			return
+		}
+	}
+}
+
+// Stats returns the manager's counters without taking the lock. The
+// counters are loaded one by one, so they may be off by the operations
+// happening meanwhile.
+func (m *SessionManager) Stats() Stats {
+	return Stats{
+		CreatedTotal:  m.stats.created.Load(),
+		LoadedTotal:   m.stats.loaded.Load(),
+		ExpiredTotal:  m.stats.expired.Load(),
+		DeletedTotal:  m.stats.deleted.Load(),
+		EvictedTotal:  m.stats.evicted.Load(),
+		CurrentActive: m.stats.active.Load(),
+	}
+}
+
+// SessionExists reports whether the session is known, without copying
+// its data
+func (m *SessionManager) SessionExists(sessionID string) bool {
+	now := m.clock.Now()
+	var ok, expired bool
+	// Deferred first, so it runs once the lock is released
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+	}()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok, expired = m.liveSession(sessionID, now)
+	return ok
+}
+
+// copyData returns a shallow copy of the session data, copying nil
+// results in an empty map
+func copyData(data map[string]interface{}) map[string]interface{} {
+	cp := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		cp[k] = v
+	}
+	return cp
+}
+
+// UpdateSessionData overwrites the old session data with a copy of
+// the new one, a nil map is stored as an empty one. The existence
+// check and the write happen under the same lock, so a concurrently
+// deleted session is never resurrected.
 func (m *SessionManager) UpdateSessionData(sessionID string, data map[string]interface{}) error {
-	_, ok := m.sessions[sessionID]
+	return m.UpdateSessionDataContext(context.Background(), sessionID, data)
+}
+
+// UpdateSessionDataContext is like UpdateSessionData but returns
+// ctx.Err() if the context is done before the session is updated
+func (m *SessionManager) UpdateSessionDataContext(ctx context.Context, sessionID string, data map[string]interface{}) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := m.clock.Now()
+	expired := false
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+		if err == nil {
+			m.notifyUpdated(sessionID)
+		}
+	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	session, ok, expired := m.liveSession(sessionID, now)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	// Keep a copy, so the caller's map never aliases the stored one
+	session.Data = copyData(data)
+	m.putSession(sessionID, session)
+	m.updateSessionExpiration(sessionID)
+	m.evictOverMemoryLimit(sessionID)
+
+	return nil
+}
+
+// UpdateSessionField sets a single key of the session data and renews
+// the session's expiry, leaving all other keys untouched
+func (m *SessionManager) UpdateSessionField(sessionID, key string, value interface{}) (err error) {
+	now := m.clock.Now()
+	expired := false
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+		if err == nil {
+			m.notifyUpdated(sessionID)
+		}
+	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	session, ok, expired := m.liveSession(sessionID, now)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	if session.Data == nil {
+		session.Data = make(map[string]interface{})
+	}
+	session.Data[key] = value
+	m.putSession(sessionID, session)
+	m.updateSessionExpiration(sessionID)
+	m.evictOverMemoryLimit(sessionID)
+
+	return nil
+}
+
+// UpdateSessionDataFunc calls mutate with the stored session data while
+// holding the manager's lock and renews the session's expiry, so a
+// read-modify-write cannot race with other updates. mutate must not
+// keep the map nor call back into the manager, which would deadlock.
+func (m *SessionManager) UpdateSessionDataFunc(sessionID string, mutate func(data map[string]interface{})) (err error) {
+	now := m.clock.Now()
+	expired := false
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+		if err == nil {
+			m.notifyUpdated(sessionID)
+		}
+	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	session, ok, expired := m.liveSession(sessionID, now)
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	if session.Data == nil {
+		session.Data = make(map[string]interface{})
+	}
+	mutate(session.Data)
+	m.putSession(sessionID, session)
+	m.updateSessionExpiration(sessionID)
+	m.evictOverMemoryLimit(sessionID)
+
+	return nil
+}
+
+// Touch renews the expiry of the session without changing its data
+func (m *SessionManager) Touch(sessionID string) error {
+	now := m.clock.Now()
+	expired := false
+	// Deferred first, so it runs once the lock is released
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	var ok bool
+	if _, ok, expired = m.liveSession(sessionID, now); !ok {
+		return ErrSessionNotFound
+	}
+
+	m.touchSession(sessionID)
+	m.updateSessionExpiration(sessionID)
+
+	return nil
+}
+
+// ExtendSession postpones the current expiry of the session by extra,
+// e.g. for a long running export. Unlike Touch it adds to the expiry
+// rather than renewing it to the ttl from now, but never beyond the
+// session's maximum lifetime. The next update renews the expiry as
+// usual, dropping the extension.
+func (m *SessionManager) ExtendSession(sessionID string, extra time.Duration) error {
+	now := m.clock.Now()
+	expired := false
+	// Deferred first, so it runs once the lock is released
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+	}()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	session, ok, expired := m.liveSession(sessionID, now)
 	if !ok {
 		return ErrSessionNotFound
 	}
 
-	// Hint: you should renew expiry of the session here
-	m.sessions[sessionID] = Session{
-		Data: data,
+	expireAt, _ := m.expiries.get(sessionID)
+	expireAt = expireAt.Add(extra)
+	if !session.deadline.IsZero() && session.deadline.Before(expireAt) {
+		expireAt = session.deadline
+	}
+	m.setSessionExpiration(sessionID, expireAt)
+
+	return nil
+}
+
+// DeleteSession removes the session immediately, e.g. on logout
+func (m *SessionManager) DeleteSession(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sessions[sessionID]; !ok {
+		return ErrSessionNotFound
 	}
 
+	m.deleteSession(sessionID)
+	m.removeSessionExpiration(sessionID)
+	m.stats.deleted.Add(1)
+	m.stats.active.Add(-1)
+	m.logger.Printf("Session %s deleted", sessionID)
+
 	return nil
 }
 
+// Clear removes every session immediately, e.g. to log everyone out.
+// The sessions count as deleted rather than expired, so OnExpire is not
+// called for them. The manager keeps working afterwards.
+func (m *SessionManager) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := int64(len(m.sessions))
+	m.sessions = make(map[string]Session)
+	m.expiries.reset()
+	m.totalBytes = 0
+	m.tagIndex = nil
+	if m.eviction != nil {
+		m.eviction.reset(m.sessions)
+	}
+	m.stats.deleted.Add(n)
+	m.stats.active.Add(-n)
+
+	if m.emptied != nil {
+		close(m.emptied)
+		m.emptied = nil
+	}
+	m.logger.Printf("Cleared %d sessions", n)
+}
+
+// ActiveSessionCount returns the number of sessions currently kept
+func (m *SessionManager) ActiveSessionCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.sessions)
+}
+
+// WaitUntilEmpty blocks until no session is left because all of them
+// expired or got deleted, e.g. to let in-flight work finish during
+// shutdown. Callers should stop creating sessions before, as new ones
+// keep it waiting. It returns ctx.Err() if the context is done first
+// and ErrManagerClosed if the manager is or gets closed, since sessions
+// no longer expire then.
+func (m *SessionManager) WaitUntilEmpty(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrManagerClosed
+	}
+	if len(m.sessions) == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	if m.emptied == nil {
+		m.emptied = make(chan struct{})
+	}
+	emptied := m.emptied
+	m.mu.Unlock()
+
+	select {
+	case <-emptied:
+		return nil
+	case <-m.done:
+		return ErrManagerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func main() {
 	// Create new sessionManager and new session
-	m := NewSessionManager()
+	m := NewSessionManager(WithLogger(log.Default()))
+	defer m.Close()
+
 	sID, err := m.CreateSession()
 	if err != nil {
 		log.Fatal(err)
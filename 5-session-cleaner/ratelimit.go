@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepSize is how many keys the rate limiter tracks before it
+// first forgets the keys whose buckets refilled completely
+const rateLimitSweepSize = 10000
+
+// ErrRateLimited returned when too many sessions were created for the
+// same key recently
+var ErrRateLimited = errors.New("Too many sessions created")
+
+// WithCreationRateLimit allows CreateSessionFor to create up to n
+// sessions per interval for the same key. Unused creations accumulate
+// up to a burst of n. An n or interval <= 0 is ignored and leaves the
+// creations unlimited.
+func WithCreationRateLimit(n int, interval time.Duration) Option {
+	return func(m *SessionManager) {
+		if n <= 0 || interval <= 0 {
+			return
+		}
+		m.limiter = &rateLimiter{
+			capacity: float64(n),
+			rate:     float64(n) / float64(interval),
+			buckets:  make(map[string]*tokenBucket),
+			sweepAt:  rateLimitSweepSize,
+		}
+	}
+}
+
+// CreateSessionFor is like CreateSession but counts the session
+// against the creation rate limit of key, e.g. the client's IP. It
+// returns ErrRateLimited once the key exceeded the limit. A creation
+// failing for another reason, e.g. ErrManagerOverloaded, does not count.
+// Without WithCreationRateLimit it never limits.
+func (m *SessionManager) CreateSessionFor(key string) (string, error) {
+	if m.limiter == nil {
+		return m.CreateSession()
+	}
+	if !m.limiter.allow(key, m.clock.Now()) {
+		return "", ErrRateLimited
+	}
+	sessionID, err := m.CreateSession()
+	if err != nil {
+		m.limiter.refund(key)
+	}
+	return sessionID, err
+}
+
+// rateLimiter keeps a token bucket per key, it is safe for concurrent
+// use
+type rateLimiter struct {
+	mu       sync.Mutex
+	capacity float64
+	// rate is the number of tokens added per nanosecond
+	rate    float64
+	buckets map[string]*tokenBucket
+	// sweepAt is the number of keys at which the next sweep runs
+	sweepAt int
+}
+
+// tokenBucket holds the tokens of a key as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow takes a token from the bucket of key and reports whether there
+// was one
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buckets) >= l.sweepAt {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.capacity, updated: now}
+		l.buckets[key] = b
+	}
+	if l.refill(b, now) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund gives back the token taken by allow for key
+func (l *rateLimiter) refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, ok := l.buckets[key]; ok && b.tokens+1 <= l.capacity {
+		b.tokens++
+	}
+}
+
+// sweep forgets the keys whose buckets refilled completely. The next
+// sweep only runs once the keys left doubled, so that many keys in use
+// at once, e.g. a client spreading requests over many IPs, do not make
+// every call scan all of them.
+func (l *rateLimiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if l.refill(b, now) >= l.capacity {
+			delete(l.buckets, k)
+		}
+	}
+
+	l.sweepAt = 2 * len(l.buckets)
+	if l.sweepAt < rateLimitSweepSize {
+		l.sweepAt = rateLimitSweepSize
+	}
+}
+
+// refill adds the tokens accumulated since the last update to b and
+// returns the tokens it holds now
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	b.tokens += float64(now.Sub(b.updated)) * l.rate
+	if b.tokens > l.capacity {
+		b.tokens = l.capacity
+	}
+	b.updated = now
+	return b.tokens
+}
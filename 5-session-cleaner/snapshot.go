@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Snapshot returns a copy of every session including its expiry, e.g.
+// to persist them before shutting down. The data maps are copied, the
+// values stored in them are not.
+func (m *SessionManager) Snapshot() map[string]Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snapshot := make(map[string]Session, len(m.sessions))
+	for sessionID, session := range m.sessions {
+		session.Data = copyData(session.Data)
+		session.expireAt, _ = m.expiries.get(sessionID)
+		snapshot[sessionID] = session
+	}
+	return snapshot
+}
+
+// LoadSnapshot adds the sessions of a Snapshot to the manager,
+// replacing sessions with the same sessionID. There are two modes:
+//
+//   - With preserveExpiry false, every loaded session expires a full
+//     ttl from now, so nothing gets evicted right after a restart.
+//   - With preserveExpiry true, every loaded session keeps the expiry
+//     it had when the snapshot was taken, so sessions which were about
+//     to expire still expire soon. Sessions which expired meanwhile
+//     are removed on the next expiration check.
+func (m *SessionManager) LoadSnapshot(snapshot map[string]Session, preserveExpiry bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	for sessionID, session := range snapshot {
+		session.Data = copyData(session.Data)
+		if session.ttl <= 0 {
+			session.ttl = m.ttl
+		}
+
+		if _, ok := m.sessions[sessionID]; !ok {
+			m.stats.loaded.Add(1)
+			m.stats.active.Add(1)
+		}
+		m.putSession(sessionID, session)
+		if preserveExpiry && !session.expireAt.IsZero() {
+			m.setSessionExpiration(sessionID, session.expireAt)
+		} else {
+			m.updateSessionExpiration(sessionID)
+		}
+	}
+	m.evictOverMemoryLimit("")
+	return nil
+}
+
+// ExportFor returns a copy of the sessions with the given sessionIDs
+// including their expiry like Snapshot, e.g. to hand them over to
+// another manager during a rolling upgrade. Unknown sessionIDs are
+// omitted. With remove the exported sessions are deleted from the
+// manager under the same lock, so they are never served by both.
+func (m *SessionManager) ExportFor(sessionIDs []string, remove bool) map[string]Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exported := make(map[string]Session, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		session, ok := m.sessions[sessionID]
+		if !ok {
+			continue
+		}
+		session.Data = copyData(session.Data)
+		session.expireAt, _ = m.expiries.get(sessionID)
+		exported[sessionID] = session
+
+		if remove {
+			m.deleteSession(sessionID)
+			m.removeSessionExpiration(sessionID)
+			m.stats.deleted.Add(1)
+			m.stats.active.Add(-1)
+			m.logger.Printf("Session %s exported", sessionID)
+		}
+	}
+	return exported
+}
+
+// ImportSessions adds the sessions returned by ExportFor of another
+// manager, keeping their expiry with withExpiry and giving them a full
+// ttl from now otherwise, see LoadSnapshot
+func (m *SessionManager) ImportSessions(sessions map[string]Session, withExpiry bool) error {
+	return m.LoadSnapshot(sessions, withExpiry)
+}
+
+// flushedSession is the JSON form of a session written by CloseAndFlush
+type flushedSession struct {
+	Data     map[string]interface{} `json:"data"`
+	TTL      time.Duration          `json:"ttl"`
+	ExpireAt time.Time              `json:"expire_at"`
+	Deadline time.Time              `json:"deadline"`
+	Tags     map[string]string      `json:"tags,omitempty"`
+}
+
+// CloseAndFlush closes the manager and writes all remaining sessions
+// as JSON to w, so they can be loaded again with LoadFrom. The worker
+// is stopped before the sessions are taken, so none of them expires
+// during the flush. The data is written as JSON, so e.g. numbers come
+// back as float64.
+func (m *SessionManager) CloseAndFlush(w io.Writer) error {
+	m.Close()
+
+	snapshot := m.Snapshot()
+	flushed := make(map[string]flushedSession, len(snapshot))
+	for sessionID, session := range snapshot {
+		flushed[sessionID] = flushedSession{
+			Data:     session.Data,
+			TTL:      session.ttl,
+			ExpireAt: session.expireAt,
+			Deadline: session.deadline,
+			Tags:     session.tags,
+		}
+	}
+	return json.NewEncoder(w).Encode(flushed)
+}
+
+// LoadFrom adds the sessions written by CloseAndFlush to the manager,
+// preserving their expiry like LoadSnapshot does with preserveExpiry
+func (m *SessionManager) LoadFrom(r io.Reader) error {
+	var flushed map[string]flushedSession
+	if err := json.NewDecoder(r).Decode(&flushed); err != nil {
+		return err
+	}
+
+	snapshot := make(map[string]Session, len(flushed))
+	for sessionID, session := range flushed {
+		snapshot[sessionID] = Session{
+			Data:     session.Data,
+			ttl:      session.TTL,
+			expireAt: session.ExpireAt,
+			deadline: session.Deadline,
+			tags:     session.Tags,
+		}
+	}
+	return m.LoadSnapshot(snapshot, true)
+}
@@ -0,0 +1,69 @@
+package main
+
+// CreateSessionWithTags creates a new session carrying a copy of tags,
+// e.g. the tenant and role of the user, and returns the sessionID. The
+// tags never change, the session can be found by them with
+// SessionsByTag until it is deleted or expires.
+func (m *SessionManager) CreateSessionWithTags(tags map[string]string) (string, error) {
+	copied := make(map[string]string, len(tags))
+	for key, value := range tags {
+		copied[key] = value
+	}
+	return m.createSession(Session{
+		Data: make(map[string]interface{}),
+		ttl:  m.ttl,
+		tags: copied,
+	})
+}
+
+// SessionsByTag returns the sessionIDs of every session tagged with key
+// set to value, in no particular order
+func (m *SessionManager) SessionsByTag(key, value string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessionIDs := make([]string, 0, len(m.tagIndex[key][value]))
+	for sessionID := range m.tagIndex[key][value] {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	return sessionIDs
+}
+
+// indexTags adds the session to the tag index, the caller must hold
+// the write lock
+func (m *SessionManager) indexTags(sessionID string, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if m.tagIndex == nil {
+		m.tagIndex = make(map[string]map[string]map[string]struct{})
+	}
+
+	for key, value := range tags {
+		values := m.tagIndex[key]
+		if values == nil {
+			values = make(map[string]map[string]struct{})
+			m.tagIndex[key] = values
+		}
+		if values[value] == nil {
+			values[value] = make(map[string]struct{})
+		}
+		values[value][sessionID] = struct{}{}
+	}
+}
+
+// unindexTags removes the session from the tag index and drops entries
+// left empty, so deleted sessions do not leak. The caller must hold the
+// write lock.
+func (m *SessionManager) unindexTags(sessionID string, tags map[string]string) {
+	for key, value := range tags {
+		values := m.tagIndex[key]
+		delete(values[value], sessionID)
+		if len(values[value]) == 0 {
+			delete(values, value)
+		}
+		if len(values) == 0 {
+			delete(m.tagIndex, key)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+// typedSessionKey is the data key a TypedSessionManager stores the
+// session's value under
+const typedSessionKey = "value"
+
+// TypedSessionManager stores a value of type T per session instead of
+// an untyped data map. Expiration is handled by the wrapped
+// SessionManager.
+type TypedSessionManager[T any] struct {
+	m *SessionManager
+}
+
+// NewTypedSessionManager wraps m to store values of type T
+func NewTypedSessionManager[T any](m *SessionManager) *TypedSessionManager[T] {
+	return &TypedSessionManager[T]{m: m}
+}
+
+// CreateSession creates a new session holding the zero value of T and
+// returns the sessionID
+func (t *TypedSessionManager[T]) CreateSession() (string, error) {
+	return t.m.CreateSession()
+}
+
+// GetSessionData returns a copy of the value related to the session if
+// sessionID is found, errors otherwise. Note that only the value
+// itself is copied, pointers, maps and slices inside T are shared.
+func (t *TypedSessionManager[T]) GetSessionData(sessionID string) (T, error) {
+	var value T
+
+	data, err := t.m.GetSessionData(sessionID)
+	if err != nil {
+		return value, err
+	}
+
+	if v, ok := data[typedSessionKey].(T); ok {
+		value = v
+	}
+	return value, nil
+}
+
+// UpdateSessionData overwrites the old session value with the new one
+// and renews the session's expiry
+func (t *TypedSessionManager[T]) UpdateSessionData(sessionID string, value T) error {
+	return t.m.UpdateSessionField(sessionID, typedSessionKey, value)
+}
+
+// DeleteSession removes the session immediately
+func (t *TypedSessionManager[T]) DeleteSession(sessionID string) error {
+	return t.m.DeleteSession(sessionID)
+}
+
+// Close stops the wrapped SessionManager
+func (t *TypedSessionManager[T]) Close() {
+	t.m.Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import "errors"
+
+// ErrVersionConflict returned when the session data changed since the
+// version the caller expected
+var ErrVersionConflict = errors.New("Session data version changed")
+
+// GetSessionWithVersion is like GetSessionData but also returns the
+// version of the data, which changes on every update. Pass it to
+// UpdateSessionDataIfVersion to detect lost updates.
+func (m *SessionManager) GetSessionWithVersion(sessionID string) (map[string]interface{}, uint64, error) {
+	now := m.clock.Now()
+	expired := false
+	// Deferred first, so it runs once the lock is released
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+	}()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok, expired := m.liveSession(sessionID, now)
+	if !ok {
+		return nil, 0, ErrSessionNotFound
+	}
+	return copyData(session.Data), session.version, nil
+}
+
+// UpdateSessionDataIfVersion is like UpdateSessionData but only updates
+// the session if its data is still at expectedVersion, otherwise it
+// returns ErrVersionConflict, so a read-modify-write cycle can be
+// retried instead of overwriting a concurrent update.
+func (m *SessionManager) UpdateSessionDataIfVersion(sessionID string, data map[string]interface{}, expectedVersion uint64) (err error) {
+	now := m.clock.Now()
+	expired := false
+	defer func() {
+		if expired {
+			m.expireSession(sessionID, now)
+		}
+		if err == nil {
+			m.notifyUpdated(sessionID)
+		}
+	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrManagerClosed
+	}
+
+	session, ok, expired := m.liveSession(sessionID, now)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if session.version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	session.Data = copyData(data)
+	m.putSession(sessionID, session)
+	m.updateSessionExpiration(sessionID)
+	m.evictOverMemoryLimit(sessionID)
+
+	return nil
+}
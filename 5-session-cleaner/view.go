@@ -0,0 +1,81 @@
+package main
+
+import "errors"
+
+// ErrKeyNotFound returned when the session data has no value for the
+// key
+var ErrKeyNotFound = errors.New("Key does not exist in session data")
+
+// ErrTypeMismatch returned when the value stored for the key has a
+// different type than requested
+var ErrTypeMismatch = errors.New("Value has a different type")
+
+// SessionView gives read-only access to the live data of a session.
+// Every getter looks the key up under its own short read lock, so the
+// internal map never leaks to the caller and reading a single key does
+// not copy the whole map. A view of a session which expired or got
+// deleted returns ErrSessionNotFound.
+type SessionView struct {
+	m         *SessionManager
+	sessionID string
+}
+
+// GetSessionView returns a view of the session if sessionID is found,
+// errors otherwise
+func (m *SessionManager) GetSessionView(sessionID string) (*SessionView, error) {
+	if !m.SessionExists(sessionID) {
+		return nil, ErrSessionNotFound
+	}
+	return &SessionView{m: m, sessionID: sessionID}, nil
+}
+
+// Get returns the value stored for key
+func (v *SessionView) Get(key string) (interface{}, error) {
+	now := v.m.clock.Now()
+	expired := false
+	// Deferred first, so it runs once the lock is released
+	defer func() {
+		if expired {
+			v.m.expireSession(v.sessionID, now)
+		}
+	}()
+
+	v.m.mu.RLock()
+	defer v.m.mu.RUnlock()
+
+	session, ok, expired := v.m.liveSession(v.sessionID, now)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	value, ok := session.Data[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// GetString returns the string stored for key
+func (v *SessionView) GetString(key string) (string, error) {
+	value, err := v.Get(key)
+	if err != nil {
+		return "", err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", ErrTypeMismatch
+	}
+	return s, nil
+}
+
+// GetInt returns the int stored for key
+func (v *SessionView) GetInt(key string) (int, error) {
+	value, err := v.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := value.(int)
+	if !ok {
+		return 0, ErrTypeMismatch
+	}
+	return i, nil
+}